@@ -15,6 +15,8 @@ func init() {
 	h.Company().AddFields(map[string]models.FieldDefinition{
 		"DefaultPriceList": models.Many2OneField{RelationModel: h.ProductPricelist(),
 			Help: "Default Price list for partners of this company"},
+		"MaxVariants": models.IntegerField{String: "Maximum Variants per Product", Default: models.DefaultValue(1000),
+			Help: "Maximum number of active variants of the products of this company. 0 means no limit."},
 	})
 
 	h.Company().Methods().Create().Extend("",
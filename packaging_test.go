@@ -0,0 +1,156 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"testing"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/operator"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPackaging(t *testing.T) {
+	Convey("Testing packagings", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			box := h.ProductPackaging().Create(env, h.ProductPackaging().NewData().
+				SetName("Box").
+				SetSequence(2).
+				SetQty(24).
+				SetProductTmpl(ptd.product2.ProductTmpl()))
+			pallet := h.ProductPackaging().Create(env, h.ProductPackaging().NewData().
+				SetName("Pallet").
+				SetSequence(1).
+				SetQty(10).
+				SetUom(ptd.uomDozen).
+				SetProductTmpl(ptd.product2.ProductTmpl()))
+			Convey("Packaging quantities are expressed in the packaging UoM", func() {
+				So(box.ProductQty(ptd.uomUnit), ShouldEqual, 24)
+				So(pallet.ProductQty(ptd.uomUnit), ShouldAlmostEqual, 120, 0.001)
+				So(box.ProductQty(ptd.uomDozen), ShouldAlmostEqual, 2, 0.001)
+			})
+			Convey("Splitting a quantity into packages", func() {
+				packs, remaining := ptd.product2.SplitIntoPackages(125, ptd.uomUnit)
+				So(packs, ShouldHaveLength, 1)
+				So(packs[0].PackagingID, ShouldEqual, pallet.ID())
+				So(packs[0].Packages, ShouldEqual, 1)
+				So(remaining, ShouldEqual, 5)
+
+				packs, remaining = ptd.product2.SplitIntoPackages(269, ptd.uomUnit)
+				So(packs, ShouldHaveLength, 2)
+				So(packs[0].Packages, ShouldEqual, 2)
+				So(packs[1].PackagingID, ShouldEqual, box.ID())
+				So(packs[1].Packages, ShouldEqual, 1)
+				So(remaining, ShouldEqual, 5)
+			})
+			Convey("Converting packages back to quantities", func() {
+				So(ptd.product2.PackagesToQuantity(box, 5, ptd.uomUnit), ShouldEqual, 120)
+			})
+			Convey("Rounding up to full packages", func() {
+				So(ptd.product2.RoundToPackages(125, ptd.uomUnit, box), ShouldEqual, 144)
+				So(ptd.product2.RoundToPackages(48, ptd.uomUnit, box), ShouldEqual, 48)
+				So(ptd.product2.RoundToPackages(125, ptd.uomUnit, h.ProductPackaging().NewSet(env)), ShouldAlmostEqual, 240, 0.001)
+				So(ptd.product1.RoundToPackages(125, ptd.uomUnit, h.ProductPackaging().NewSet(env)), ShouldEqual, 125)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestPackagingNesting(t *testing.T) {
+	Convey("Testing packaging nesting", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			ptd.product2.SetWeight(0.5)
+			pallet := h.ProductPackaging().Create(env, h.ProductPackaging().NewData().
+				SetName("Pallet").
+				SetTareWeight(25).
+				SetBarcode("10012345678902").
+				SetProductTmpl(ptd.product2.ProductTmpl()))
+			box := h.ProductPackaging().Create(env, h.ProductPackaging().NewData().
+				SetName("Box").
+				SetQty(24).
+				SetTareWeight(1).
+				SetPackagingLength(0.4).
+				SetWidth(0.3).
+				SetHeight(0.2).
+				SetParent(pallet).
+				SetParentQty(40).
+				SetProductTmpl(ptd.product2.ProductTmpl()))
+			Convey("Totals are computed from contained packagings", func() {
+				So(box.ContainedQty(), ShouldEqual, 24)
+				So(box.GrossWeight(), ShouldEqual, 13)
+				So(box.Volume(), ShouldAlmostEqual, 0.024, 0.00001)
+				So(pallet.ContainedQty(), ShouldEqual, 960)
+				So(pallet.GrossWeight(), ShouldEqual, 545)
+			})
+			Convey("Nesting packagings are used for conversions", func() {
+				So(ptd.product2.AvailablePackagings().Len(), ShouldEqual, 2)
+				So(pallet.ContainedProductQty(ptd.uomDozen), ShouldAlmostEqual, 80, 0.001)
+				packs, remaining := ptd.product2.SplitIntoPackages(1000, ptd.uomUnit)
+				So(packs, ShouldHaveLength, 2)
+				So(packs[0].PackagingID, ShouldEqual, pallet.ID())
+				So(packs[0].Packages, ShouldEqual, 1)
+				So(packs[1].PackagingID, ShouldEqual, box.ID())
+				So(packs[1].Packages, ShouldEqual, 1)
+				So(remaining, ShouldEqual, 16)
+				So(ptd.product2.PackagesToQuantity(pallet, 2, ptd.uomUnit), ShouldEqual, 1920)
+				So(ptd.product2.RoundToPackages(1000, ptd.uomUnit, pallet), ShouldEqual, 1920)
+			})
+			Convey("Recursive packagings are forbidden", func() {
+				So(func() { pallet.SetParent(box) }, ShouldPanic)
+			})
+			Convey("Barcodes must be valid GTINs", func() {
+				So(func() { box.SetBarcode("10012345678903") }, ShouldPanic)
+				So(func() { box.SetBarcode("ABC") }, ShouldPanic)
+				So(func() { box.SetBarcode("4006381333931") }, ShouldNotPanic)
+			})
+			Convey("Products can be found from their packaging barcode", func() {
+				res := h.ProductProduct().NewSet(env).SearchByName("10012345678902", operator.Equals, q.ProductProductCondition{}, 0)
+				So(res.Equals(ptd.product2), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestVariantPackaging(t *testing.T) {
+	Convey("Testing variant specific packagings", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			templateBox := h.ProductPackaging().Create(env, h.ProductPackaging().NewData().
+				SetName("Box").
+				SetQty(12).
+				SetProductTmpl(ptd.template7))
+			redBox := h.ProductPackaging().Create(env, h.ProductPackaging().NewData().
+				SetName("Box").
+				SetQty(6).
+				SetBarcode("4006381333931").
+				SetProduct(ptd.product71))
+			Convey("Variant packagings are preferred over template ones", func() {
+				So(redBox.ProductTmpl().Equals(ptd.template7), ShouldBeTrue)
+				So(ptd.product71.AvailablePackagings().Equals(redBox), ShouldBeTrue)
+				So(ptd.product72.AvailablePackagings().Equals(templateBox), ShouldBeTrue)
+				So(ptd.product71.GetPackaging("Box").Equals(redBox), ShouldBeTrue)
+				So(ptd.product72.GetPackaging("Box").Equals(templateBox), ShouldBeTrue)
+				So(ptd.product72.GetPackaging("Pallet").IsEmpty(), ShouldBeTrue)
+				So(ptd.product71.RoundToPackages(7, ptd.uomUnit, h.ProductPackaging().NewSet(env)), ShouldEqual, 12)
+			})
+			Convey("Variant packaging barcodes find the variant only", func() {
+				res := h.ProductProduct().NewSet(env).SearchByName("4006381333931", operator.Equals, q.ProductProductCondition{}, 0)
+				So(res.Equals(ptd.product71), ShouldBeTrue)
+			})
+			Convey("Variant packagings must belong to the template", func() {
+				So(func() {
+					h.ProductPackaging().Create(env, h.ProductPackaging().NewData().
+						SetName("Box").
+						SetProductTmpl(ptd.template7).
+						SetProduct(ptd.product2))
+				}, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
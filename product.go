@@ -6,7 +6,9 @@ package product
 import (
 	"fmt"
 	"log"
+	"math"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/hexya-addons/base"
@@ -125,15 +127,22 @@ func init() {
 			Inverse: h.ProductProduct().Methods().InverseProductPrice()},
 		"PriceExtra": models.FloatField{String: "Variant Price Extra",
 			Compute: h.ProductProduct().Methods().ComputeProductPriceExtra(),
-			Depends: []string{"AttributeValues", "AttributeValues.Prices", "AttributeValues.Prices.PriceExtra", "AttributeValues.Prices.ProductTmpl"},
-			Digits:  decimalPrecision.GetPrecision("Product Price"),
-			Help:    "This is the sum of the extra price of all attributes"},
+			Depends: []string{"ListPrice", "AttributeValues", "AttributeValues.Prices", "AttributeValues.Prices.PriceExtra",
+				"AttributeValues.Prices.ProductTmpl", "AttributeValues.Prices.ExtraType", "AttributeValues.Prices.PricePercent",
+				"AttributeValues.Prices.Sequence"},
+			Digits: decimalPrecision.GetPrecision("Product Price"),
+			Help:   "This is the price difference due to the extras of all attributes"},
 		"LstPrice": models.FloatField{String: "Sale Price",
 			Compute: h.ProductProduct().Methods().ComputeProductLstPrice(),
-			Depends: []string{"ListPrice", "PriceExtra"},
+			Depends: []string{"ListPrice", "PriceExtra", "ListPriceOverride", "VariantListPrice"},
 			Digits:  decimalPrecision.GetPrecision("Product Price"),
 			Inverse: h.ProductProduct().Methods().InverseProductLstPrice(),
 			Help:    "The sale price is managed from the product template. Click on the 'Variant Prices' button to set the extra attribute prices."},
+		"ListPriceOverride": models.BooleanField{String: "Fixed Sale Price",
+			Help: "If set, the sale price of this variant is its own sale price instead of the sale price of the product plus the attribute extras."},
+		"VariantListPrice": models.FloatField{String: "Variant Sale Price",
+			Digits: decimalPrecision.GetPrecision("Product Price"),
+			Help:   "Sale price of this variant when it has a fixed sale price, in the default unit of measure of the product."},
 		"DefaultCode": models.CharField{String: "Internal Reference", Index: true},
 		"Code": models.CharField{String: "Internal Reference",
 			Compute: h.ProductProduct().Methods().ComputeProductCode(), Depends: []string{""}},
@@ -174,9 +183,11 @@ resized as a 1024x1024px image, with aspect ratio preserved.`},
 			},
 			Help: `Cost of the product template used for standard stock valuation in accounting and used as a
 base price on purchase orders. Expressed in the default unit of measure of the product.`},
-		"Volume": models.FloatField{Help: "The volume in m3."},
+		"Volume": models.FloatField{Help: "The volume in m3.",
+			Constraint: h.ProductProduct().Methods().CheckTypeData()},
 		"Weight": models.FloatField{Digits: decimalPrecision.GetPrecision("Stock Weight"),
-			Help: "The weight of the contents in Kg, not including any packaging, etc."},
+			Constraint: h.ProductProduct().Methods().CheckTypeData(),
+			Help:       "The weight of the contents in Kg, not including any packaging, etc."},
 		"PricelistItems": models.Many2ManyField{RelationModel: h.ProductPricelistItem(),
 			JSON: "pricelist_item_ids", Compute: h.ProductProduct().Methods().GetPricelistItems()},
 	})
@@ -207,48 +218,86 @@ base price on purchase orders. Expressed in the default unit of measure of the p
 		})
 
 	h.ProductProduct().Methods().InverseProductPrice().DeclareMethod(
-		`InverseProductPrice updates ListPrice from the given Price`,
+		`InverseProductPrice updates ListPrice from the given Price,
+		or VariantListPrice if this variant has a fixed sale price.`,
 		func(rs m.ProductProductSet, price float64) {
 			if rs.Env().Context().HasKey("uom") {
 				price = h.ProductUom().Browse(rs.Env(), []int64{rs.Env().Context().GetInteger("uom")}).ComputePrice(price, rs.Uom())
 			}
-			price -= rs.PriceExtra()
-			rs.SetListPrice(price)
+			if rs.ListPriceOverride() {
+				rs.SetVariantListPrice(price)
+				return
+			}
+			factor, amount := rs.PriceExtraFormula()
+			rs.SetListPrice((price - amount) / factor)
 		})
 
 	h.ProductProduct().Methods().InverseProductLstPrice().DeclareMethod(
-		`InverseProductLstPrice updates ListPrice from the given LstPrice`,
+		`InverseProductLstPrice updates ListPrice from the given LstPrice,
+		or VariantListPrice if this variant has a fixed sale price.`,
 		func(rs m.ProductProductSet, price float64) {
 			if rs.Env().Context().HasKey("uom") {
 				price = h.ProductUom().Browse(rs.Env(), []int64{rs.Env().Context().GetInteger("uom")}).ComputePrice(price, rs.Uom())
 			}
-			price -= rs.PriceExtra()
-			rs.SetListPrice(price)
+			if rs.ListPriceOverride() {
+				rs.SetVariantListPrice(price)
+				return
+			}
+			factor, amount := rs.PriceExtraFormula()
+			rs.SetListPrice((price - amount) / factor)
 		})
 
 	h.ProductProduct().Methods().ComputeProductPriceExtra().DeclareMethod(
-		`ComputeProductPriceExtra computes the price extra of this product by suming the extras of each attribute`,
+		`ComputeProductPriceExtra computes the price extra of this product by applying the extras of each attribute
+		to the ListPrice of the product (see PriceExtraFormula).`,
 		func(rs m.ProductProductSet) m.ProductProductData {
-			var priceExtra float64
-			for _, attributeValue := range rs.AttributeValues().Records() {
-				for _, attributePrice := range attributeValue.Prices().Records() {
-					if attributePrice.ProductTmpl().Equals(rs.ProductTmpl()) {
-						priceExtra += attributePrice.PriceExtra()
-					}
+			factor, amount := rs.PriceExtraFormula()
+			listPrice := rs.ListPrice()
+			return h.ProductProduct().NewData().SetPriceExtra(factor*listPrice + amount - listPrice)
+		})
+
+	h.ProductProduct().Methods().PriceExtraFormula().DeclareMethod(
+		`PriceExtraFormula returns the factor and the amount such that the price of this variant with
+		its attribute extras is factor * ListPrice + amount.
+
+		The extras of the attribute values of this variant are applied in the order of their sequence.
+		Fixed extras are added to the price and percentage extras increase the price computed so far,
+		that is the ListPrice plus the extras applied before them.`,
+		func(rs m.ProductProductSet) (float64, float64) {
+			factor, amount := 1.0, 0.0
+			if rs.IsEmpty() {
+				return factor, amount
+			}
+			prices := h.ProductAttributePrice().Search(rs.Env(),
+				q.ProductAttributePrice().Value().In(rs.AttributeValues()).
+					And().ProductTmpl().Equals(rs.ProductTmpl())).OrderBy("Sequence", "ID")
+			for _, attributePrice := range prices.Records() {
+				switch attributePrice.ExtraType() {
+				case "percentage":
+					rate := 1 + attributePrice.PricePercent()/100
+					factor *= rate
+					amount *= rate
+				default:
+					amount += attributePrice.PriceExtra()
 				}
 			}
-			return h.ProductProduct().NewData().SetPriceExtra(priceExtra)
+			return factor, amount
 		})
 
 	h.ProductProduct().Methods().ComputeProductLstPrice().DeclareMethod(
-		`ComputeProductLstPrice computes the LstPrice from the ListPrice and the extras`,
+		`ComputeProductLstPrice computes the LstPrice from the ListPrice and the extras,
+		or from the VariantListPrice if this variant has a fixed sale price.`,
 		func(rs m.ProductProductSet) m.ProductProductData {
 			listPrice := rs.ListPrice()
+			priceExtra := rs.PriceExtra()
+			if rs.ListPriceOverride() {
+				listPrice, priceExtra = rs.VariantListPrice(), 0
+			}
 			if rs.Env().Context().HasKey("uom") {
 				toUoM := h.ProductUom().Browse(rs.Env(), []int64{rs.Env().Context().GetInteger("uom")})
 				listPrice = rs.Uom().ComputePrice(listPrice, toUoM)
 			}
-			return h.ProductProduct().NewData().SetLstPrice(listPrice + rs.PriceExtra())
+			return h.ProductProduct().NewData().SetLstPrice(listPrice + priceExtra)
 		})
 
 	h.ProductProduct().Methods().ComputeProductCode().DeclareMethod(
@@ -521,6 +570,17 @@ base price on purchase orders. Expressed in the default unit of measure of the p
 				if products.IsEmpty() {
 					products = rs.Search(q.ProductProduct().Barcode().Equals(name).AndCond(additionalCond)).Limit(limit)
 				}
+				if products.IsEmpty() {
+					packaging := h.ProductPackaging().Search(rs.Env(), q.ProductPackaging().Barcode().Equals(name))
+					switch {
+					case packaging.IsEmpty():
+					case !packaging.Product().IsEmpty():
+						products = rs.Search(q.ProductProduct().ID().Equals(packaging.Product().ID()).AndCond(additionalCond))
+					default:
+						products = rs.Search(q.ProductProduct().ProductTmpl().Equals(packaging.ProductTmpl()).
+							AndCond(additionalCond)).Limit(limit)
+					}
+				}
 			}
 			switch {
 			case products.IsEmpty() && !op.IsNegative():
@@ -579,17 +639,56 @@ base price on purchase orders. Expressed in the default unit of measure of the p
 
 	h.ProductProduct().Methods().SelectSeller().DeclareMethod(
 		`SelectSeller returns the ProductSupplierInfo to use for the given partner, quantity, date and UoM.
-		If any of the parameters are their Go zero value, then they are not used for filtering.`,
-		func(rs m.ProductProductSet, partner m.PartnerSet, quantity float64, date dates.Date, uom m.ProductUomSet) m.ProductSupplierinfoSet {
+		If any of the parameters are their Go zero value, then they are not used for filtering.
+
+		policy defines which vendor is selected among the matching ones. See RankSellers for
+		the available policies. An empty policy selects the first vendor by sequence.`,
+		func(rs m.ProductProductSet, partner m.PartnerSet, quantity float64, date dates.Date, uom m.ProductUomSet, policy string) m.ProductSupplierinfoSet {
+			rs.EnsureOne()
+			sellers := rs.RankSellers(partner, quantity, date, uom, policy)
+			if sellers.IsEmpty() {
+				return sellers
+			}
+			return sellers.Records()[0]
+		})
+
+	h.ProductProduct().Methods().RankSellers().DeclareMethod(
+		`RankSellers returns all the ProductSupplierInfo matching the given partner, quantity, date and UoM
+		ordered from the best to the worst offer according to the given policy. If any of the parameters are
+		their Go zero value, then they are not used for filtering. The quantity is expressed in the given
+		UoM, or in the product's default UoM if uom is empty, and is converted into each vendor's purchase
+		UoM before being compared to its minimal quantity.
+
+		Available policies are:
+
+		- 'sequence' (default): vendors are ordered by Sequence, then by MinQty descending and Price,
+		- 'price': cheapest unit price first, compared in the company currency and the product UoM,
+		- 'delay': shortest delivery lead time first,
+		- 'lead_time': shortest expected lead time first, i.e. the mean observed lead time,
+		- 'reliability': highest on time rate first. Vendors without observed lead times come last,
+		- 'score': lowest weighted score of price, expected lead time and lateness rate first. Weights are
+		  read from the 'seller_price_weight', 'seller_delay_weight' and 'seller_reliability_weight'
+		  context keys. The first two default to 1 and the last one to 0.
+
+		Vendors with the same rank keep their sequence order.`,
+		func(rs m.ProductProductSet, partner m.PartnerSet, quantity float64, date dates.Date, uom m.ProductUomSet, policy string) m.ProductSupplierinfoSet {
 			rs.EnsureOne()
 			if date.IsZero() {
 				date = dates.Today()
 			}
+			if uom.IsEmpty() {
+				uom = rs.Uom()
+			}
 			res := h.ProductSupplierinfo().NewSet(rs.Env())
+			var candidates []m.ProductSupplierinfoSet
 			for _, seller := range rs.Sellers().Records() {
+				if !seller.Active() {
+					continue
+				}
 				quantityUomSeller := quantity
-				if quantityUomSeller != 0 && !uom.IsEmpty() && !uom.Equals(seller.ProductUom()) {
-					quantityUomSeller = uom.ComputeQuantity(quantityUomSeller, seller.ProductUom(), true)
+				sellerUom := seller.PurchaseUom()
+				if quantityUomSeller != 0 && !sellerUom.IsEmpty() && !uom.Equals(sellerUom) {
+					quantityUomSeller = uom.ComputeQuantity(quantityUomSeller, sellerUom, true)
 				}
 				if !seller.DateStart().IsZero() && seller.DateStart().Greater(date) {
 					continue
@@ -606,8 +705,76 @@ base price on purchase orders. Expressed in the default unit of measure of the p
 				if !seller.Product().IsEmpty() && !seller.Product().Equals(rs) {
 					continue
 				}
-				res = res.Union(seller)
-				break
+				candidates = append(candidates, seller)
+			}
+			if len(candidates) == 0 {
+				return res
+			}
+			keys := make([]float64, len(candidates))
+			switch policy {
+			case "", "sequence":
+			case "price":
+				for i, seller := range candidates {
+					keys[i] = seller.ComparablePrice(rs)
+				}
+			case "delay":
+				for i, seller := range candidates {
+					keys[i] = float64(seller.Delay())
+				}
+			case "lead_time":
+				for i, seller := range candidates {
+					keys[i] = seller.ExpectedDelay()
+				}
+			case "reliability":
+				for i, seller := range candidates {
+					keys[i] = 1
+					if seller.LeadTimeCount() > 0 {
+						keys[i] = -seller.OnTimeRate()
+					}
+				}
+			case "score":
+				priceWeight, delayWeight, reliabilityWeight := 1.0, 1.0, 0.0
+				if rs.Env().Context().HasKey("seller_price_weight") {
+					priceWeight = rs.Env().Context().GetFloat("seller_price_weight")
+				}
+				if rs.Env().Context().HasKey("seller_delay_weight") {
+					delayWeight = rs.Env().Context().GetFloat("seller_delay_weight")
+				}
+				if rs.Env().Context().HasKey("seller_reliability_weight") {
+					reliabilityWeight = rs.Env().Context().GetFloat("seller_reliability_weight")
+				}
+				prices := make([]float64, len(candidates))
+				delays := make([]float64, len(candidates))
+				var maxPrice, maxDelay float64
+				for i, seller := range candidates {
+					prices[i] = seller.ComparablePrice(rs)
+					delays[i] = seller.ExpectedDelay()
+					maxPrice = math.Max(maxPrice, prices[i])
+					maxDelay = math.Max(maxDelay, delays[i])
+				}
+				for i, seller := range candidates {
+					if maxPrice > 0 {
+						keys[i] += priceWeight * prices[i] / maxPrice
+					}
+					if maxDelay > 0 {
+						keys[i] += delayWeight * delays[i] / maxDelay
+					}
+					if seller.LeadTimeCount() > 0 {
+						keys[i] += reliabilityWeight * (1 - seller.OnTimeRate())
+					}
+				}
+			default:
+				log.Panic(rs.T("Unknown vendor selection policy: %s", policy))
+			}
+			indexes := make([]int, len(candidates))
+			for i := range indexes {
+				indexes[i] = i
+			}
+			sort.SliceStable(indexes, func(i, j int) bool {
+				return keys[indexes[i]] < keys[indexes[j]]
+			})
+			for _, i := range indexes {
+				res = res.Union(candidates[i])
 			}
 			return res
 		})
@@ -626,8 +793,10 @@ base price on purchase orders. Expressed in the default unit of measure of the p
 				currency = h.Currency().NewSet(rs.Env()).Browse([]int64{rs.Env().Context().GetInteger("currency")})
 			}
 
+			isCost := priceType.FieldName() == q.ProductProduct().StandardPrice().FieldName()
+			isListPrice := priceType.FieldName() == q.ProductProduct().ListPrice().FieldName()
 			product := rs
-			if priceType == q.ProductProduct().StandardPrice() {
+			if isCost {
 				// StandardPrice field can only be seen by users in base.group_user
 				// Thus, in order to compute the sale price from the cost for users not in this group
 				// We fetch the standard price as the superuser
@@ -641,7 +810,16 @@ base price on purchase orders. Expressed in the default unit of measure of the p
 			}
 
 			price := product.Get(priceType.String()).(float64)
-			if priceType == q.ProductProduct().ListPrice() {
+			switch {
+			case rs.IsKit() && isCost:
+				price = product.ProductTmpl().ComputeKitCost()
+			case rs.ListPriceOverride() && isListPrice:
+				// fixed variant prices replace the product price and the attribute extras
+				price = product.VariantListPrice()
+			case rs.IsKit() && rs.KitPricing() && isListPrice:
+				price = product.ProductTmpl().ComputeKitListPrice()
+			}
+			if isListPrice && !rs.ListPriceOverride() {
 				price += product.PriceExtra()
 			}
 
@@ -693,55 +871,4 @@ base price on purchase orders. Expressed in the default unit of measure of the p
 			return false
 		})
 
-	h.ProductPackaging().DeclareModel()
-	h.ProductPackaging().SetDefaultOrder("Sequence")
-
-	h.ProductPackaging().AddFields(map[string]models.FieldDefinition{
-		"Name": models.CharField{String: "Packaging Type", Required: true},
-		"Sequence": models.IntegerField{Default: models.DefaultValue(1),
-			Help: "The first in the sequence is the default one."},
-		"ProductTmpl": models.Many2OneField{String: "Product", RelationModel: h.ProductTemplate()},
-		"Qty": models.FloatField{String: "Quantity per Package",
-			Help: "The total number of products you can have per pallet or box."},
-	})
-
-	h.ProductSupplierinfo().DeclareModel()
-	h.ProductSupplierinfo().SetDefaultOrder("Sequence", "MinQty DESC", "Price")
-
-	h.ProductSupplierinfo().AddFields(map[string]models.FieldDefinition{
-		"Name": models.Many2OneField{String: "Vendor", RelationModel: h.Partner(), JSON: "name",
-			Filter: q.Partner().Supplier().Equals(true), OnDelete: models.Cascade, Required: true,
-			Help: "Vendor of this product"},
-		"ProductName": models.CharField{String: "Vendor Product Name",
-			Help: `This vendor's product name will be used when printing a request for quotation.
-Keep empty to use the internal one.`},
-		"ProductCode": models.CharField{String: "Vendor Product Code",
-			Help: `This vendor's product code will be used when printing a request for quotation.
-Keep empty to use the internal one.`},
-		"Sequence": models.IntegerField{Default: models.DefaultValue(1),
-			Help: "Assigns the priority to the list of product vendor."},
-		"ProductUom": models.Many2OneField{String: "Vendor Unit of Measure", RelationModel: h.ProductUom(),
-			ReadOnly: true, Related: "ProductTmpl.UomPo", Help: "This comes from the product form."},
-		"MinQty": models.FloatField{String: "Minimal Quantity", Default: models.DefaultValue(0), Required: true,
-			Help: `The minimal quantity to purchase from this vendor, expressed in the vendor Product Unit of Measure if any,
-or in the default unit of measure of the product otherwise.`},
-		"Price": models.FloatField{Default: models.DefaultValue(0), Digits: decimalPrecision.GetPrecision("Product Price"),
-			Required: true, Help: "The price to purchase a product"},
-		"Company": models.Many2OneField{RelationModel: h.Company(), Default: func(env models.Environment) interface{} {
-			return h.User().NewSet(env).CurrentUser().Company()
-		}, Index: true},
-		"Currency": models.Many2OneField{RelationModel: h.Currency(), Default: func(env models.Environment) interface{} {
-			return h.User().NewSet(env).CurrentUser().Company().Currency()
-		}, Required: true},
-		"DateStart": models.DateField{String: "Start Date", Help: "Start date for this vendor price"},
-		"DateEnd":   models.DateField{String: "End Date", Help: "End date for this vendor price"},
-		"Product": models.Many2OneField{String: "Product Variant", RelationModel: h.ProductProduct(),
-			Help: "When this field is filled in, the vendor data will only apply to the variant."},
-		"ProductTmpl": models.Many2OneField{String: "Product Template", RelationModel: h.ProductTemplate(),
-			Index: true, OnDelete: models.Cascade},
-		"Delay": models.IntegerField{String: "Delivery Lead Time", Default: models.DefaultValue(1), Required: true,
-			Help: `Lead time in days between the confirmation of the purchase order and the receipt of the
-products in your warehouse. Used by the scheduler for automatic computation of the purchase order planning.`},
-	})
-
 }
@@ -6,16 +6,27 @@ package product
 import (
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
 
 	"github.com/hexya-addons/decimalPrecision"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/operator"
+	"github.com/hexya-erp/hexya/src/models/types"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
 	"github.com/hexya-erp/pool/q"
 )
 
+// normalizeValueName returns the given attribute value name in lower case,
+// without surrounding spaces and with inner spaces collapsed.
+func normalizeValueName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// htmlColorRegexp matches HTML colors in hexadecimal notation such as #fff or #1f2e3d.
+var htmlColorRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
 func init() {
 
 	h.ProductAttribute().DeclareModel()
@@ -30,16 +41,75 @@ func init() {
 			ReverseFK: "Attribute", JSON: "attribute_line_ids"},
 		"CreateVariant": models.BooleanField{Default: models.DefaultValue(true),
 			Help: "Check this if you want to create multiple variants for this attribute."},
+		"CreateVariantMode": models.SelectionField{String: "Variants Creation Mode", Selection: types.Selection{
+			"always":  "Instantly",
+			"dynamic": "Dynamically",
+			"never":   "Never",
+		}, Default: models.DefaultValue("always"), Required: true,
+			Constraint: h.ProductAttribute().Methods().CheckCustomValues(),
+			Help: `Instantly: all possible variants are created as soon as the attribute and its values are added to a product.
+Dynamically: each variant is created only when its combination of attribute values is requested.
+Never: variants are never created for this attribute.`},
+		"DisplayType": models.SelectionField{String: "Display Type", Selection: types.Selection{
+			"radio":  "Radio",
+			"select": "Select",
+			"color":  "Color",
+			"image":  "Image",
+		}, Default: models.DefaultValue("radio"), Required: true,
+			Help: "The display type used in the product configurator."},
 	})
 
+	h.ProductAttribute().Methods().CheckCustomValues().DeclareMethod(
+		`CheckCustomValues checks that attributes with custom values do not create variants.`,
+		func(rs m.ProductAttributeSet) {
+			for _, attribute := range rs.Records() {
+				if attribute.CreateVariantMode() == "never" {
+					continue
+				}
+				if !attribute.Values().Filtered(func(r m.ProductAttributeValueSet) bool { return r.IsCustom() }).IsEmpty() {
+					log.Panic(rs.T("Error: Attribute %s has custom values and cannot create variants.", attribute.Name()))
+				}
+			}
+		})
+
+	h.ProductAttribute().Methods().SyncCreateVariantMode().DeclareMethod(
+		`SyncCreateVariantMode keeps the CreateVariant flag and the CreateVariantMode of
+		the given data consistent. The mode takes precedence if both are set.`,
+		func(rs m.ProductAttributeSet, data m.ProductAttributeData) {
+			switch {
+			case data.HasCreateVariantMode():
+				data.SetCreateVariant(data.CreateVariantMode() != "never")
+			case data.HasCreateVariant() && data.CreateVariant():
+				data.SetCreateVariantMode("always")
+			case data.HasCreateVariant():
+				data.SetCreateVariantMode("never")
+			}
+		})
+
+	h.ProductAttribute().Methods().Create().Extend("",
+		func(rs m.ProductAttributeSet, data m.ProductAttributeData) m.ProductAttributeSet {
+			rs.SyncCreateVariantMode(data)
+			return rs.Super().Create(data)
+		})
+
+	h.ProductAttribute().Methods().Write().Extend("",
+		func(rs m.ProductAttributeSet, vals m.ProductAttributeData) bool {
+			rs.SyncCreateVariantMode(vals)
+			return rs.Super().Write(vals)
+		})
+
 	h.ProductAttributeValue().DeclareModel()
-	h.ProductAttributeValue().SetDefaultOrder("Sequence")
+	h.ProductAttributeValue().SetDefaultOrder("Sequence", "NumericValue", "DateValue", "ID")
 
 	h.ProductAttributeValue().AddFields(map[string]models.FieldDefinition{
-		"Name":     models.CharField{String: "Value", Required: true, Translate: true},
+		"Name": models.CharField{String: "Value", Required: true, Translate: true,
+			Constraint: h.ProductAttributeValue().Methods().CheckUniqueName()},
 		"Sequence": models.IntegerField{Help: "Determine the display order"},
+		"Active": models.BooleanField{Default: models.DefaultValue(true), Required: true,
+			Help: `If unchecked, this value cannot be added to attribute lines and no new variant is created
+with it. The existing variants using it are kept.`},
 		"Attribute": models.Many2OneField{RelationModel: h.ProductAttribute(), OnDelete: models.Cascade,
-			Required: true},
+			Required: true, Constraint: h.ProductAttributeValue().Methods().CheckUniqueName()},
 		"Products": models.Many2ManyField{String: "Variants", RelationModel: h.ProductProduct(),
 			JSON: "product_ids"},
 		"PriceExtra": models.FloatField{String: "Attribute Price Extra",
@@ -47,30 +117,105 @@ func init() {
 			Inverse: h.ProductAttributeValue().Methods().InversePriceExtra(),
 			Default: models.DefaultValue(0), Digits: decimalPrecision.GetPrecision("Product Price"),
 			Help: "Price Extra: Extra price for the variant with this attribute value on sale price. eg. 200 price extra, 1000 + 200 = 1200."},
+		"ExtraType": models.SelectionField{String: "Extra Type", Selection: types.Selection{
+			"fixed":      "Fixed Amount",
+			"percentage": "Percentage",
+		}, Compute: h.ProductAttributeValue().Methods().ComputePriceExtra(),
+			Inverse: h.ProductAttributeValue().Methods().InverseExtraType(),
+			Help:    "Whether the extra price of this value for the product is a fixed amount or a percentage."},
+		"PricePercent": models.FloatField{String: "Price Extra (%)",
+			Compute: h.ProductAttributeValue().Methods().ComputePriceExtra(),
+			Inverse: h.ProductAttributeValue().Methods().InversePricePercent(),
+			Help:    "Percentage by which the price of the variant with this attribute value is increased."},
 		"Prices": models.One2ManyField{String: "Attribute Prices", RelationModel: h.ProductAttributePrice(),
 			ReverseFK: "Value", JSON: "price_ids", ReadOnly: true},
+		"HtmlColor": models.CharField{String: "HTML Color",
+			Constraint: h.ProductAttributeValue().Methods().CheckHtmlColor(),
+			Help: `Here you can set a specific HTML color index (e.g. #ff0000) to display the color
+if the attribute display type is 'Color'.`},
+		"Image": models.BinaryField{
+			Help: "Image displayed for this value if the attribute display type is 'Image'."},
+		"IsCustom": models.BooleanField{String: "Is Custom Value",
+			Constraint: h.ProductAttributeValue().Methods().CheckIsCustom(),
+			Help: `Allow customers to type their own text for this value, such as an engraving.
+The text is stored on the order line and no variant is created for it.`},
 	})
 
-	// TODO Convert to constrains method
-	//h.ProductAttributeValue().AddSQLConstraint("ValueCompanyUniq", "unique (name,attribute_id)", "This attribute value already exists !")
+	h.ProductAttributeValue().Methods().CheckHtmlColor().DeclareMethod(
+		`CheckHtmlColor checks that the HTML color of this value is in hexadecimal notation.`,
+		func(rs m.ProductAttributeValueSet) {
+			for _, value := range rs.Records() {
+				if value.HtmlColor() != "" && !htmlColorRegexp.MatchString(value.HtmlColor()) {
+					log.Panic(rs.T("Error: %s is not a valid HTML color. Use the #rrggbb notation.", value.HtmlColor()))
+				}
+			}
+		})
+
+	h.ProductAttributeValue().Methods().CheckIsCustom().DeclareMethod(
+		`CheckIsCustom checks that custom values belong to text attributes that do not create variants.`,
+		func(rs m.ProductAttributeValueSet) {
+			for _, value := range rs.Records() {
+				if !value.IsCustom() {
+					continue
+				}
+				if value.Attribute().CreateVariantMode() != "never" {
+					log.Panic(rs.T("Error: Custom values can only be added to attributes that never create variants."))
+				}
+				if value.Attribute().ValueType() != "text" {
+					log.Panic(rs.T("Error: Custom values can only be added to text attributes."))
+				}
+			}
+		})
+
+	h.ProductAttributeValue().Methods().CheckUniqueName().DeclareMethod(
+		`CheckUniqueName checks that no other value of the same attribute has the same name,
+		ignoring case and surrounding spaces. Names are compared both in the language of the
+		context and in the untranslated names.`,
+		func(rs m.ProductAttributeValueSet) {
+			for _, defaultNames := range []bool{false, true} {
+				rSet := rs.WithContext("hexya_default_contexts", defaultNames)
+				for _, value := range rSet.Records() {
+					others := h.ProductAttributeValue().NewSet(rSet.Env()).WithContext("active_test", false).Search(
+						q.ProductAttributeValue().Attribute().Equals(value.Attribute()).
+							And().ID().NotEquals(value.ID()))
+					for _, other := range others.Records() {
+						if normalizeValueName(other.Name()) == normalizeValueName(value.Name()) {
+							log.Panic(rs.T("Error: The value %s already exists for attribute %s.",
+								value.Name(), value.Attribute().Name()))
+						}
+					}
+				}
+			}
+		})
 
 	h.ProductAttributeValue().Methods().ComputePriceExtra().DeclareMethod(
-		`ComputePriceExtra returns the price extra for this attribute for the product
-		template passed as 'active_id' in the context. Returns 0 if there is not 'active_id'.`,
+		`ComputePriceExtra returns the price extra, its type and its percentage for this attribute
+		for the product template passed as 'active_id' in the context. Returns a fixed extra of 0 if
+		there is not 'active_id'.`,
 		func(rs m.ProductAttributeValueSet) m.ProductAttributeValueData {
-			var priceExtra float64
-			if rs.Env().Context().HasKey("active_id") {
-				productTmpl := h.ProductTemplate().Browse(rs.Env(), []int64{rs.Env().Context().GetInteger("active_id")})
-				price := rs.Prices().Search(q.ProductAttributePrice().ProductTmpl().Equals(productTmpl))
-				priceExtra = price.PriceExtra()
+			res := h.ProductAttributeValue().NewData().
+				SetPriceExtra(0).
+				SetExtraType("fixed").
+				SetPricePercent(0)
+			if !rs.Env().Context().HasKey("active_id") {
+				return res
 			}
-			return h.ProductAttributeValue().NewData().SetPriceExtra(priceExtra)
+			productTmpl := h.ProductTemplate().Browse(rs.Env(), []int64{rs.Env().Context().GetInteger("active_id")})
+			price := rs.Prices().Search(q.ProductAttributePrice().ProductTmpl().Equals(productTmpl))
+			if price.IsEmpty() {
+				return res
+			}
+			return res.
+				SetPriceExtra(price.PriceExtra()).
+				SetExtraType(price.ExtraType()).
+				SetPricePercent(price.PricePercent())
 		})
 
-	h.ProductAttributeValue().Methods().InversePriceExtra().DeclareMethod(
-		`InversePriceExtra sets the price extra based on the product
-		template passed as 'active_id'. Does nothing if there is not 'active_id'.`,
-		func(rs m.ProductAttributeValueSet, value float64) {
+	h.ProductAttributeValue().Methods().WriteTemplatePrices().DeclareMethod(
+		`WriteTemplatePrices writes the given data on the attribute prices of the values of this set
+		for the product template passed as 'active_id', creating the missing attribute prices.
+		Does nothing if there is not 'active_id'.`,
+		func(rs m.ProductAttributeValueSet, data m.ProductAttributePriceData) {
 			if !rs.Env().Context().HasKey("active_id") {
 				return
 			}
@@ -78,19 +223,41 @@ func init() {
 			prices := h.ProductAttributePrice().Search(rs.Env(),
 				q.ProductAttributePrice().Value().In(rs).And().ProductTmpl().Equals(productTmpl))
 			if !prices.IsEmpty() {
-				prices.SetPriceExtra(value)
-				return
+				prices.Write(data)
 			}
 			updated := h.ProductAttributeValue().NewSet(rs.Env())
 			for _, price := range prices.Records() {
 				updated = updated.Union(price.Value())
 			}
 			for _, val := range rs.Subtract(updated).Records() {
-				h.ProductAttributePrice().Create(rs.Env(), h.ProductAttributePrice().NewData().
+				h.ProductAttributePrice().Create(rs.Env(), data.Copy().
 					SetProductTmpl(productTmpl).
-					SetValue(val).
-					SetPriceExtra(value))
+					SetValue(val))
+			}
+		})
+
+	h.ProductAttributeValue().Methods().InversePriceExtra().DeclareMethod(
+		`InversePriceExtra sets the price extra based on the product
+		template passed as 'active_id'. Does nothing if there is not 'active_id'.`,
+		func(rs m.ProductAttributeValueSet, value float64) {
+			rs.WriteTemplatePrices(h.ProductAttributePrice().NewData().SetPriceExtra(value))
+		})
+
+	h.ProductAttributeValue().Methods().InverseExtraType().DeclareMethod(
+		`InverseExtraType sets the type of the price extra based on the product
+		template passed as 'active_id'. Does nothing if there is not 'active_id'.`,
+		func(rs m.ProductAttributeValueSet, value string) {
+			if value == "" {
+				value = "fixed"
 			}
+			rs.WriteTemplatePrices(h.ProductAttributePrice().NewData().SetExtraType(value))
+		})
+
+	h.ProductAttributeValue().Methods().InversePricePercent().DeclareMethod(
+		`InversePricePercent sets the percentage of the price extra based on the product
+		template passed as 'active_id'. Does nothing if there is not 'active_id'.`,
+		func(rs m.ProductAttributeValueSet, value float64) {
+			rs.WriteTemplatePrices(h.ProductAttributePrice().NewData().SetPricePercent(value))
 		})
 
 	h.ProductAttributeValue().Methods().NameGet().Extend("",
@@ -107,7 +274,8 @@ func init() {
 				q.ProductProduct().AttributeValues().In(rs))
 			if !linkedProducts.IsEmpty() {
 				log.Panic(rs.T(`The operation cannot be completed:
-You are trying to delete an attribute value with a reference on a product variant.`))
+You are trying to delete an attribute value with a reference on a product variant.
+You can archive the attribute value instead.`))
 			}
 			return rs.Super().Unlink()
 		})
@@ -124,21 +292,43 @@ You are trying to delete an attribute value with a reference on a product varian
 				if attrValue.Attribute().Intersect(variableAttribute).IsEmpty() {
 					continue
 				}
-				names = append(names, attrValue.Name())
+				names = append(names, attrValue.FormattedValue())
 			}
 			return strings.Join(names, ", ")
 		})
 
 	h.ProductAttributePrice().DeclareModel()
+	h.ProductAttributePrice().SetDefaultOrder("Sequence", "ID")
 
 	h.ProductAttributePrice().AddFields(map[string]models.FieldDefinition{
 		"ProductTmpl": models.Many2OneField{String: "Product Template", RelationModel: h.ProductTemplate(),
 			OnDelete: models.Cascade, Required: true},
 		"Value": models.Many2OneField{String: "Product Attribute Value", RelationModel: h.ProductAttributeValue(),
 			OnDelete: models.Cascade, Required: true},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(10),
+			Help: "Determine the order in which the extras of a variant are applied"},
+		"ExtraType": models.SelectionField{String: "Extra Type", Selection: types.Selection{
+			"fixed":      "Fixed Amount",
+			"percentage": "Percentage",
+		}, Default: models.DefaultValue("fixed"), Required: true,
+			Help: `Fixed Amount: the price extra is added to the price of the variant.
+Percentage: the price of the variant is increased by the given percentage of the price
+computed so far, that is the product price plus the extras applied before this one.`},
 		"PriceExtra": models.FloatField{String: "Price Extra", Digits: decimalPrecision.GetPrecision("Product Price")},
+		"PricePercent": models.FloatField{String: "Price Extra (%)",
+			Constraint: h.ProductAttributePrice().Methods().CheckPricePercent()},
 	})
 
+	h.ProductAttributePrice().Methods().CheckPricePercent().DeclareMethod(
+		`CheckPricePercent checks that percentage extras do not decrease prices by 100% or more.`,
+		func(rs m.ProductAttributePriceSet) {
+			for _, price := range rs.Records() {
+				if price.PricePercent() <= -100 {
+					log.Panic(rs.T("Error: A percentage price extra must be greater than -100%%."))
+				}
+			}
+		})
+
 	h.ProductAttributeLine().DeclareModel()
 
 	h.ProductAttributeLine().AddFields(map[string]models.FieldDefinition{
@@ -0,0 +1,98 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.ProductAttributeValue().AddFields(map[string]models.FieldDefinition{
+		"ArchivedVariants": models.Many2ManyField{String: "Archived Variants", RelationModel: h.ProductProduct(),
+			JSON: "archived_variant_ids", ReadOnly: true, NoCopy: true,
+			Help: "Variants archived together with this value, that are reactivated when this value is unarchived."},
+	})
+
+	h.ProductAttributeValue().Methods().ArchiveValues().DeclareMethod(
+		`ArchiveValues archives the attribute values of this set. If archiveVariants is true,
+		the active variants using these values are archived too and are reactivated when the
+		values are unarchived. Otherwise they are kept unchanged, but no new variant is created
+		with these values.`,
+		func(rs m.ProductAttributeValueSet, archiveVariants bool) {
+			rs.SetActive(false)
+			if !archiveVariants {
+				return
+			}
+			for _, value := range rs.Records() {
+				variants := h.ProductProduct().Search(rs.Env(), q.ProductProduct().AttributeValues().Equals(value))
+				value.SetArchivedVariants(value.ArchivedVariants().Union(variants))
+				variants.SetActive(false)
+			}
+		})
+
+	h.ProductAttributeValue().Methods().ActionArchiveWithVariants().DeclareMethod(
+		`ActionArchiveWithVariants archives the attribute values of this set and the variants using them.`,
+		func(rs m.ProductAttributeValueSet) {
+			rs.ArchiveValues(true)
+		})
+
+	h.ProductAttributeValue().Methods().Write().Extend("",
+		func(rs m.ProductAttributeValueSet, vals m.ProductAttributeValueData) bool {
+			res := rs.Super().Write(vals)
+			if !vals.HasActive() || !vals.Active() {
+				return res
+			}
+			// Only the variants archived by ArchiveValues are reactivated. Missing combinations
+			// are created the next time the variants of the templates are updated.
+			for _, value := range rs.Records() {
+				if value.ArchivedVariants().IsEmpty() {
+					continue
+				}
+				value.ArchivedVariants().SetActive(true)
+				value.SetArchivedVariants(h.ProductProduct().NewSet(rs.Env()))
+			}
+			return res
+		})
+
+	h.ProductAttributeLine().Methods().CheckArchivedValues().DeclareMethod(
+		`CheckArchivedValues panics if the given values add archived attribute values to these lines.
+		Archived values already on a line can be kept.`,
+		func(rs m.ProductAttributeLineSet, values m.ProductAttributeValueSet) {
+			archived := values.Filtered(func(r m.ProductAttributeValueSet) bool { return !r.Active() })
+			if archived.IsEmpty() {
+				return
+			}
+			if rs.IsEmpty() {
+				log.Panic(rs.T("Error: Value %s is archived and cannot be added to a product.", archived.Records()[0].NameGet()))
+			}
+			for _, line := range rs.Records() {
+				if added := archived.Subtract(line.Values()); !added.IsEmpty() {
+					log.Panic(rs.T("Error: Value %s is archived and cannot be added to a product.", added.Records()[0].NameGet()))
+				}
+			}
+		})
+
+	h.ProductAttributeLine().Methods().Create().Extend("",
+		func(rs m.ProductAttributeLineSet, data m.ProductAttributeLineData) m.ProductAttributeLineSet {
+			if data.HasValues() {
+				rs.CheckArchivedValues(data.Values())
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.ProductAttributeLine().Methods().Write().Extend("",
+		func(rs m.ProductAttributeLineSet, vals m.ProductAttributeLineData) bool {
+			if vals.HasValues() {
+				rs.CheckArchivedValues(vals.Values())
+			}
+			return rs.Super().Write(vals)
+		})
+
+}
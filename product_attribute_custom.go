@@ -0,0 +1,86 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// maxCustomValueLength is the maximum number of characters of a custom value text.
+const maxCustomValueLength = 255
+
+func init() {
+
+	h.ProductAttributeCustomValue().DeclareModel()
+
+	h.ProductAttributeCustomValue().AddFields(map[string]models.FieldDefinition{
+		"Value": models.Many2OneField{String: "Attribute Value", RelationModel: h.ProductAttributeValue(),
+			OnDelete: models.Restrict, Required: true,
+			Filter:     q.ProductAttributeValue().IsCustom().Equals(true),
+			Constraint: h.ProductAttributeCustomValue().Methods().CheckCustomValue()},
+		"CustomValue": models.CharField{String: "Custom Value", Required: true,
+			Constraint: h.ProductAttributeCustomValue().Methods().CheckCustomValue(),
+			Help:       "Text typed by the customer for the custom attribute value."},
+	})
+
+	h.ProductAttributeCustomValue().Methods().CheckCustomValue().DeclareMethod(
+		`CheckCustomValue checks that the attribute value of this record is a custom value and
+		that the text typed by the customer is neither empty nor too long.`,
+		func(rs m.ProductAttributeCustomValueSet) {
+			for _, custom := range rs.Records() {
+				if !custom.Value().IsCustom() {
+					log.Panic(rs.T("Error: Value %s does not accept custom values.", custom.Value().NameGet()))
+				}
+				if strings.TrimSpace(custom.CustomValue()) == "" {
+					log.Panic(rs.T("Error: The custom value for %s cannot be empty.", custom.Value().NameGet()))
+				}
+				if len([]rune(custom.CustomValue())) > maxCustomValueLength {
+					log.Panic(rs.T("Error: The custom value for %s cannot be longer than %d characters.",
+						custom.Value().NameGet(), maxCustomValueLength))
+				}
+			}
+		})
+
+	h.ProductAttributeCustomValue().Methods().NameGet().Extend("",
+		func(rs m.ProductAttributeCustomValueSet) string {
+			return fmt.Sprintf("%s: %s", rs.Value().Attribute().Name(), rs.CustomValue())
+		})
+
+	h.ProductAttributeCustomValue().Methods().Create().Extend("",
+		func(rs m.ProductAttributeCustomValueSet, data m.ProductAttributeCustomValueData) m.ProductAttributeCustomValueSet {
+			if data.HasCustomValue() {
+				data.SetCustomValue(strings.TrimSpace(data.CustomValue()))
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.ProductAttributeCustomValue().Methods().Write().Extend("",
+		func(rs m.ProductAttributeCustomValueSet, vals m.ProductAttributeCustomValueData) bool {
+			if vals.HasCustomValue() {
+				vals.SetCustomValue(strings.TrimSpace(vals.CustomValue()))
+			}
+			return rs.Super().Write(vals)
+		})
+
+	h.ProductTemplate().Methods().CustomAttributeValues().DeclareMethod(
+		`CustomAttributeValues returns the custom values of the attribute lines of this template,
+		for which the customer is asked to type a text.`,
+		func(rs m.ProductTemplateSet) m.ProductAttributeValueSet {
+			res := h.ProductAttributeValue().NewSet(rs.Env())
+			for _, line := range rs.AttributeLines().Records() {
+				res = res.Union(line.Values().Filtered(func(r m.ProductAttributeValueSet) bool {
+					return r.IsCustom()
+				}))
+			}
+			return res
+		})
+
+}
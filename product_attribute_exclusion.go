@@ -0,0 +1,103 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+func init() {
+
+	h.ProductAttributeExclusion().DeclareModel()
+
+	h.ProductAttributeExclusion().AddFields(map[string]models.FieldDefinition{
+		"ProductTmpl": models.Many2OneField{String: "Product Template", RelationModel: h.ProductTemplate(),
+			OnDelete: models.Cascade, Required: true, Index: true,
+			Constraint: h.ProductAttributeExclusion().Methods().CheckValues()},
+		"Value": models.Many2OneField{String: "Attribute Value", RelationModel: h.ProductAttributeValue(),
+			OnDelete: models.Cascade, Required: true,
+			Constraint: h.ProductAttributeExclusion().Methods().CheckValues()},
+		"ExcludedValues": models.Many2ManyField{String: "Excluded Values", RelationModel: h.ProductAttributeValue(),
+			JSON: "excluded_value_ids", Constraint: h.ProductAttributeExclusion().Methods().CheckValues(),
+			Help: "Values of other attributes that cannot be combined with the attribute value in a variant."},
+	})
+
+	h.ProductAttributeExclusion().Methods().CheckValues().DeclareMethod(
+		`CheckValues checks that the values of this rule are used by the attribute lines of its template
+		and that a value does not exclude values of its own attribute.`,
+		func(rs m.ProductAttributeExclusionSet) {
+			for _, rule := range rs.Records() {
+				tmplValues := h.ProductAttributeValue().NewSet(rs.Env())
+				for _, line := range rule.ProductTmpl().AttributeLines().Records() {
+					tmplValues = tmplValues.Union(line.Values())
+				}
+				if rule.ExcludedValues().IsEmpty() {
+					log.Panic(rs.T("Error: An exclusion rule must exclude at least one value."))
+				}
+				if !rule.Value().Union(rule.ExcludedValues()).Subtract(tmplValues).IsEmpty() {
+					log.Panic(rs.T("Error: The values of an exclusion rule must be values of the attribute lines of its product."))
+				}
+				for _, value := range rule.ExcludedValues().Records() {
+					if value.Attribute().Equals(rule.Value().Attribute()) {
+						log.Panic(rs.T("Error: An attribute value cannot exclude values of its own attribute."))
+					}
+				}
+			}
+		})
+
+	h.ProductAttributeExclusion().Methods().NameGet().Extend("",
+		func(rs m.ProductAttributeExclusionSet) string {
+			return rs.Value().NameGet()
+		})
+
+	h.ProductAttributeExclusion().Methods().Create().Extend("",
+		func(rs m.ProductAttributeExclusionSet, data m.ProductAttributeExclusionData) m.ProductAttributeExclusionSet {
+			res := rs.Super().Create(data)
+			res.ProductTmpl().CreateVariants()
+			return res
+		})
+
+	h.ProductAttributeExclusion().Methods().Write().Extend("",
+		func(rs m.ProductAttributeExclusionSet, vals m.ProductAttributeExclusionData) bool {
+			templates := rs.ProductTmpl()
+			res := rs.Super().Write(vals)
+			templates.Union(rs.ProductTmpl()).CreateVariants()
+			return res
+		})
+
+	h.ProductAttributeExclusion().Methods().Unlink().Extend("",
+		func(rs m.ProductAttributeExclusionSet) int64 {
+			templates := rs.ProductTmpl()
+			res := rs.Super().Unlink()
+			templates.CreateVariants()
+			return res
+		})
+
+	h.ProductTemplate().AddFields(map[string]models.FieldDefinition{
+		"VariantExclusions": models.One2ManyField{String: "Exclusion Rules", RelationModel: h.ProductAttributeExclusion(),
+			ReverseFK: "ProductTmpl", JSON: "variant_exclusion_ids",
+			Help: "Rules defining the combinations of attribute values for which no variant is created."},
+	})
+
+	h.ProductTemplate().Methods().IsCombinationExcluded().DeclareMethod(
+		`IsCombinationExcluded returns true if the given combination of attribute values is
+		forbidden by an exclusion rule of this template.`,
+		func(rs m.ProductTemplateSet, values m.ProductAttributeValueSet) bool {
+			rs.EnsureOne()
+			for _, rule := range rs.VariantExclusions().Records() {
+				if rule.Value().Intersect(values).IsEmpty() {
+					continue
+				}
+				if !rule.ExcludedValues().Intersect(values).IsEmpty() {
+					return true
+				}
+			}
+			return false
+		})
+
+}
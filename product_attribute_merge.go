@@ -0,0 +1,166 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.ProductAttributeValue().Methods().MergeInto().DeclareMethod(
+		`MergeInto folds the values of this set into the given target value of the same attribute
+		and deletes them. Variants, attribute lines, attribute prices, exclusion rules and custom
+		values referencing the merged values are updated to reference the target instead.
+
+		If a variant would end up with the same values as another variant of its product,
+		it is archived. Only one price is kept per product: the price of the target if it has one,
+		or the first price of the merged values otherwise.`,
+		func(rs m.ProductAttributeValueSet, target m.ProductAttributeValueSet) {
+			target.EnsureOne()
+			merged := rs.Subtract(target)
+			if merged.IsEmpty() {
+				return
+			}
+			for _, value := range merged.Records() {
+				if !value.Attribute().Equals(target.Attribute()) {
+					log.Panic(rs.T("Error: Only values of the same attribute can be merged."))
+				}
+			}
+			// Variants
+			variants := h.ProductProduct().NewSet(rs.Env()).WithContext("active_test", false).Search(
+				q.ProductProduct().AttributeValues().In(merged))
+			for _, variant := range variants.Records() {
+				values := variant.AttributeValues().Subtract(merged).Union(target)
+				key := variantKey(values.Ids())
+				twins := h.ProductProduct().NewSet(rs.Env()).WithContext("active_test", false).Search(
+					q.ProductProduct().ProductTmpl().Equals(variant.ProductTmpl()).
+						And().ID().NotEquals(variant.ID()))
+				duplicate := false
+				for _, twin := range twins.Records() {
+					if variantKey(twin.AttributeValues().Ids()) == key {
+						duplicate = true
+						break
+					}
+				}
+				data := h.ProductProduct().NewData().SetAttributeValues(values)
+				if duplicate {
+					data.SetActive(false)
+				}
+				variant.Write(data)
+			}
+			// Attribute lines
+			lines := h.ProductAttributeLine().Search(rs.Env(), q.ProductAttributeLine().Values().In(merged))
+			for _, line := range lines.Records() {
+				line.SetValues(line.Values().Subtract(merged).Union(target))
+			}
+			// Attribute prices
+			pricedTemplates := make(map[int64]bool)
+			for _, price := range h.ProductAttributePrice().Search(rs.Env(),
+				q.ProductAttributePrice().Value().Equals(target)).Records() {
+				pricedTemplates[price.ProductTmpl().ID()] = true
+			}
+			prices := h.ProductAttributePrice().Search(rs.Env(), q.ProductAttributePrice().Value().In(merged))
+			for _, price := range prices.Records() {
+				if pricedTemplates[price.ProductTmpl().ID()] {
+					price.Unlink()
+					continue
+				}
+				price.SetValue(target)
+				pricedTemplates[price.ProductTmpl().ID()] = true
+			}
+			// Exclusion rules
+			h.ProductAttributeExclusion().Search(rs.Env(), q.ProductAttributeExclusion().Value().In(merged)).
+				SetValue(target)
+			exclusions := h.ProductAttributeExclusion().Search(rs.Env(),
+				q.ProductAttributeExclusion().ExcludedValues().In(merged))
+			for _, exclusion := range exclusions.Records() {
+				exclusion.SetExcludedValues(exclusion.ExcludedValues().Subtract(merged).Union(target))
+			}
+			// Custom values
+			h.ProductAttributeCustomValue().Search(rs.Env(), q.ProductAttributeCustomValue().Value().In(merged)).
+				SetValue(target)
+			merged.Unlink()
+		})
+
+	h.ProductAttribute().Methods().MergeDuplicateValues().DeclareMethod(
+		`MergeDuplicateValues merges the values of these attributes having the same untranslated
+		name, ignoring case and surrounding spaces. Duplicates are merged into the first active value
+		in the default order of values. It returns the values that have been kept.`,
+		func(rs m.ProductAttributeSet) m.ProductAttributeValueSet {
+			res := h.ProductAttributeValue().NewSet(rs.Env())
+			for _, attribute := range rs.Records() {
+				values := h.ProductAttributeValue().NewSet(rs.Env()).
+					WithContext("hexya_default_contexts", true).WithContext("active_test", false).
+					Search(q.ProductAttributeValue().Attribute().Equals(attribute))
+				groups := make(map[string][]int64)
+				targets := make(map[string]int64)
+				var names []string
+				for _, value := range values.Records() {
+					name := normalizeValueName(value.Name())
+					if _, exists := groups[name]; !exists {
+						names = append(names, name)
+						targets[name] = value.ID()
+					}
+					groups[name] = append(groups[name], value.ID())
+					if value.Active() && !h.ProductAttributeValue().Browse(rs.Env(), []int64{targets[name]}).Active() {
+						targets[name] = value.ID()
+					}
+				}
+				for _, name := range names {
+					if len(groups[name]) < 2 {
+						continue
+					}
+					target := h.ProductAttributeValue().Browse(rs.Env(), []int64{targets[name]})
+					h.ProductAttributeValue().Browse(rs.Env(), groups[name]).MergeInto(target)
+					res = res.Union(target)
+				}
+			}
+			return res
+		})
+
+	h.ProductAttributeValueMerge().DeclareTransientModel()
+
+	h.ProductAttributeValueMerge().AddFields(map[string]models.FieldDefinition{
+		"Attribute": models.Many2OneField{RelationModel: h.ProductAttribute(), Required: true},
+		"Values": models.Many2ManyField{String: "Values to Merge", RelationModel: h.ProductAttributeValue(),
+			JSON: "value_ids"},
+		"Target": models.Many2OneField{String: "Merge Into", RelationModel: h.ProductAttributeValue(),
+			Help: "Value kept after the merge. The other values are deleted."},
+	})
+
+	h.ProductAttributeValueMerge().Methods().ActionMerge().DeclareMethod(
+		`ActionMerge merges the selected values into the target value and closes the popup.`,
+		func(rs m.ProductAttributeValueMergeSet) *actions.Action {
+			rs.EnsureOne()
+			if rs.Target().IsEmpty() {
+				log.Panic(rs.T("Error: Please select the value to merge into."))
+			}
+			if !rs.Target().Attribute().Equals(rs.Attribute()) {
+				log.Panic(rs.T("Error: The value to merge into must be a value of the selected attribute."))
+			}
+			rs.Values().MergeInto(rs.Target())
+			return &actions.Action{
+				Type: actions.ActionCloseWindow,
+			}
+		})
+
+	h.ProductAttributeValueMerge().Methods().ActionMergeDuplicates().DeclareMethod(
+		`ActionMergeDuplicates merges all the values of the selected attribute that only differ
+		by case or spaces and closes the popup.`,
+		func(rs m.ProductAttributeValueMergeSet) *actions.Action {
+			rs.EnsureOne()
+			rs.Attribute().MergeDuplicateValues()
+			return &actions.Action{
+				Type: actions.ActionCloseWindow,
+			}
+		})
+
+}
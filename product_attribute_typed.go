@@ -0,0 +1,203 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/operator"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.ProductAttribute().AddFields(map[string]models.FieldDefinition{
+		"ValueType": models.SelectionField{String: "Value Type", Selection: types.Selection{
+			"text":    "Text",
+			"numeric": "Numeric",
+			"boolean": "Yes/No",
+			"date":    "Date",
+		}, Default: models.DefaultValue("text"), Required: true,
+			Constraint: h.ProductAttribute().Methods().CheckValueType(),
+			Help: `Text: values are only identified by their name.
+Numeric, Yes/No, Date: values hold a typed value from which their name is computed
+and which can be used to sort and search variants.`},
+		"Uom": models.Many2OneField{String: "Unit of Measure", RelationModel: h.ProductUom(),
+			Constraint: h.ProductAttribute().Methods().CheckValueType(),
+			Help:       "Unit of measure of the values of a numeric attribute."},
+	})
+
+	h.ProductAttribute().Methods().CheckValueType().DeclareMethod(
+		`CheckValueType checks that only numeric attributes have a unit of measure
+		and that only text attributes have custom values.`,
+		func(rs m.ProductAttributeSet) {
+			for _, attribute := range rs.Records() {
+				if !attribute.Uom().IsEmpty() && attribute.ValueType() != "numeric" {
+					log.Panic(rs.T("Error: Only numeric attributes can have a unit of measure."))
+				}
+				if attribute.ValueType() == "text" {
+					continue
+				}
+				if !attribute.Values().Filtered(func(r m.ProductAttributeValueSet) bool { return r.IsCustom() }).IsEmpty() {
+					log.Panic(rs.T("Error: Attribute %s has custom values and must be a text attribute.", attribute.Name()))
+				}
+			}
+		})
+
+	h.ProductAttribute().Methods().Write().Extend("",
+		func(rs m.ProductAttributeSet, vals m.ProductAttributeData) bool {
+			if !vals.HasValueType() && !vals.HasUom() {
+				return rs.Super().Write(vals)
+			}
+			oldUoms := make(map[int64]m.ProductUomSet)
+			for _, attribute := range rs.Records() {
+				if attribute.Values().IsEmpty() {
+					continue
+				}
+				if vals.HasValueType() && vals.ValueType() != attribute.ValueType() {
+					log.Panic(rs.T("Error: The value type of attribute %s cannot be changed since it has values.", attribute.Name()))
+				}
+				if !vals.HasUom() || vals.Uom().Equals(attribute.Uom()) {
+					continue
+				}
+				if attribute.Uom().IsEmpty() || vals.Uom().IsEmpty() || !vals.Uom().Category().Equals(attribute.Uom().Category()) {
+					log.Panic(rs.T(`Error: The unit of measure of attribute %s can only be replaced by a unit
+of the same category since it has values.`, attribute.Name()))
+				}
+				oldUoms[attribute.ID()] = attribute.Uom()
+			}
+			res := rs.Super().Write(vals)
+			// numeric values are converted into the new unit of measure
+			for _, attribute := range rs.Records() {
+				oldUom, converted := oldUoms[attribute.ID()]
+				if !converted {
+					continue
+				}
+				for _, value := range attribute.Values().Records() {
+					value.SetNumericValue(oldUom.ComputeQuantity(value.NumericValue(), attribute.Uom(), false))
+				}
+			}
+			rs.Values().UpdateTypedNames()
+			return res
+		})
+
+	h.ProductAttribute().Methods().FormatValue().DeclareMethod(
+		`FormatValue returns the name of an attribute value of this attribute holding the
+		typed value of the given data. Numeric values are followed by the unit of measure of
+		this attribute. It returns the name of the data for text attributes.`,
+		func(rs m.ProductAttributeSet, data m.ProductAttributeValueData) string {
+			rs.EnsureOne()
+			switch rs.ValueType() {
+			case "numeric":
+				res := strconv.FormatFloat(data.NumericValue(), 'f', -1, 64)
+				if !rs.Uom().IsEmpty() {
+					res += " " + rs.Uom().Name()
+				}
+				return res
+			case "boolean":
+				if data.BooleanValue() {
+					return rs.T("With %s", rs.Name())
+				}
+				return rs.T("Without %s", rs.Name())
+			case "date":
+				return data.DateValue().String()
+			}
+			return data.Name()
+		})
+
+	h.ProductAttribute().Methods().VariantCondition().DeclareMethod(
+		`VariantCondition returns a condition on product variants selecting the variants with a
+		value of this attribute matching the given operator and value, e.g. capacity >= 32 GB.
+
+		The value must be a float64 or an int for numeric attributes, a bool for Yes/No attributes,
+		a dates.Date for date attributes and a string for text attributes. Numeric values are
+		converted from the given unit of measure into the unit of this attribute if uom is not empty.`,
+		func(rs m.ProductAttributeSet, op operator.Operator, value interface{}, uom m.ProductUomSet) q.ProductProductCondition {
+			rs.EnsureOne()
+			var valueCond q.ProductAttributeValueCondition
+			switch val := value.(type) {
+			case int:
+				return rs.VariantCondition(op, float64(val), uom)
+			case float64:
+				if rs.ValueType() != "numeric" {
+					log.Panic(rs.T("Attribute %s is not numeric", rs.Name()))
+				}
+				if !uom.IsEmpty() && !rs.Uom().IsEmpty() {
+					val = uom.ComputeQuantity(val, rs.Uom(), false)
+				}
+				valueCond = q.ProductAttributeValue().NumericValue().AddOperator(op, val)
+			case bool:
+				if rs.ValueType() != "boolean" {
+					log.Panic(rs.T("Attribute %s is not a Yes/No attribute", rs.Name()))
+				}
+				valueCond = q.ProductAttributeValue().BooleanValue().AddOperator(op, val)
+			case dates.Date:
+				if rs.ValueType() != "date" {
+					log.Panic(rs.T("Attribute %s is not a date attribute", rs.Name()))
+				}
+				valueCond = q.ProductAttributeValue().DateValue().AddOperator(op, val)
+			case string:
+				valueCond = q.ProductAttributeValue().Name().AddOperator(op, val)
+			default:
+				log.Panic(rs.T("Unsupported value %v for attribute %s", value, rs.Name()))
+			}
+			return q.ProductProduct().AttributeValuesFilteredOn(
+				q.ProductAttributeValue().Attribute().Equals(rs).AndCond(valueCond))
+		})
+
+	h.ProductAttributeValue().AddFields(map[string]models.FieldDefinition{
+		"NumericValue": models.FloatField{String: "Numeric Value",
+			Help: "Value of a numeric attribute, expressed in the unit of measure of the attribute."},
+		"BooleanValue": models.BooleanField{String: "Yes/No Value"},
+		"DateValue":    models.DateField{String: "Date Value"},
+	})
+
+	h.ProductAttributeValue().Methods().FormattedValue().DeclareMethod(
+		`FormattedValue returns the value of this attribute value as displayed in variant names.`,
+		func(rs m.ProductAttributeValueSet) string {
+			rs.EnsureOne()
+			return rs.Attribute().FormatValue(h.ProductAttributeValue().NewData().
+				SetName(rs.Name()).
+				SetNumericValue(rs.NumericValue()).
+				SetBooleanValue(rs.BooleanValue()).
+				SetDateValue(rs.DateValue()))
+		})
+
+	h.ProductAttributeValue().Methods().UpdateTypedNames().DeclareMethod(
+		`UpdateTypedNames sets the name of the values of typed attributes in this set from their typed value.`,
+		func(rs m.ProductAttributeValueSet) {
+			for _, value := range rs.Records() {
+				if value.Attribute().ValueType() == "text" {
+					continue
+				}
+				if name := value.FormattedValue(); name != value.Name() {
+					value.SetName(name)
+				}
+			}
+		})
+
+	h.ProductAttributeValue().Methods().Create().Extend("",
+		func(rs m.ProductAttributeValueSet, data m.ProductAttributeValueData) m.ProductAttributeValueSet {
+			if data.HasAttribute() && data.Attribute().ValueType() != "text" {
+				data.SetName(data.Attribute().FormatValue(data))
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.ProductAttributeValue().Methods().Write().Extend("",
+		func(rs m.ProductAttributeValueSet, vals m.ProductAttributeValueData) bool {
+			res := rs.Super().Write(vals)
+			if vals.HasNumericValue() || vals.HasBooleanValue() || vals.HasDateValue() || vals.HasAttribute() || vals.HasName() {
+				rs.UpdateTypedNames()
+			}
+			return res
+		})
+
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+
+	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.ProductKitLine().DeclareModel()
+	h.ProductKitLine().SetDefaultOrder("Sequence", "ID")
+
+	h.ProductKitLine().AddFields(map[string]models.FieldDefinition{
+		"KitTmpl": models.Many2OneField{String: "Kit", RelationModel: h.ProductTemplate(), Required: true,
+			OnDelete: models.Cascade, Index: true, JSON: "kit_tmpl_id",
+			Constraint: h.ProductKitLine().Methods().CheckComponent()},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(10)},
+		"Product": models.Many2OneField{String: "Component", RelationModel: h.ProductProduct(), Required: true,
+			OnDelete: models.Restrict, Constraint: h.ProductKitLine().Methods().CheckComponent()},
+		"Quantity": models.FloatField{Default: models.DefaultValue(1.0), Required: true,
+			Digits: decimalPrecision.GetPrecision("Product Unit of Measure"),
+			Help:   "Quantity of this component in one unit of the kit."},
+		"Uom": models.Many2OneField{String: "Unit of Measure", RelationModel: h.ProductUom(),
+			Constraint: h.ProductKitLine().Methods().CheckComponent(),
+			Help:       "Unit of measure of the quantity. Keep empty to use the default unit of measure of the component."},
+	})
+
+	h.ProductKitLine().Methods().CheckComponent().DeclareMethod(
+		`CheckComponent checks that the unit of measure of this line is in the category of the component's
+		and that the kit does not contain itself, directly or through other kits.`,
+		func(rs m.ProductKitLineSet) {
+			for _, line := range rs.Records() {
+				if !line.Uom().IsEmpty() && !line.Uom().Category().Equals(line.Product().Uom().Category()) {
+					log.Panic(rs.T("Error: The unit of measure of a kit component must be in the same category as the unit of measure of the component."))
+				}
+				visited := make(map[int64]bool)
+				toVisit := line.Product().ProductTmpl()
+				for !toVisit.IsEmpty() {
+					if toVisit.Intersect(line.KitTmpl()).Len() > 0 {
+						log.Panic(rs.T("Error ! You cannot create recursive kits."))
+					}
+					next := h.ProductTemplate().NewSet(rs.Env())
+					for _, tmpl := range toVisit.Records() {
+						if visited[tmpl.ID()] {
+							continue
+						}
+						visited[tmpl.ID()] = true
+						for _, subLine := range tmpl.KitLines().Records() {
+							next = next.Union(subLine.Product().ProductTmpl())
+						}
+					}
+					toVisit = next
+				}
+			}
+		})
+
+	h.ProductKitLine().Methods().ProductQty().DeclareMethod(
+		`ProductQty returns the quantity of this line in the default unit of measure of the component.`,
+		func(rs m.ProductKitLineSet) float64 {
+			rs.EnsureOne()
+			return rs.Uom().ComputeQuantity(rs.Quantity(), rs.Product().Uom(), false)
+		})
+
+	h.ProductKitLine().Methods().Create().Extend("",
+		func(rs m.ProductKitLineSet, data m.ProductKitLineData) m.ProductKitLineSet {
+			if !data.HasUom() && data.HasProduct() {
+				data.SetUom(data.Product().Uom())
+			}
+			res := rs.Super().Create(data)
+			res.KitTmpl().UpdateKitPrices()
+			return res
+		})
+
+	h.ProductKitLine().Methods().Write().Extend("",
+		func(rs m.ProductKitLineSet, vals m.ProductKitLineData) bool {
+			kits := rs.KitTmpl()
+			res := rs.Super().Write(vals)
+			kits.Union(rs.KitTmpl()).UpdateKitPrices()
+			return res
+		})
+
+	h.ProductKitLine().Methods().Unlink().Extend("",
+		func(rs m.ProductKitLineSet) int64 {
+			kits := rs.KitTmpl()
+			res := rs.Super().Unlink()
+			kits.UpdateKitPrices()
+			return res
+		})
+
+	h.ProductTemplate().AddFields(map[string]models.FieldDefinition{
+		"IsKit": models.BooleanField{String: "Is a Kit",
+			Help: "If set, this product is made of the components listed in the kit lines and its cost is computed from them."},
+		"KitLines": models.One2ManyField{String: "Components", RelationModel: h.ProductKitLine(),
+			ReverseFK: "KitTmpl", JSON: "kit_line_ids"},
+		"KitPricing": models.BooleanField{String: "Price from Components",
+			Help: `If set, the sale price of this kit is the sum of the sale prices of its components minus the
+bundle discount. Pricelist rules based on the public price or the cost of this kit apply on the prices
+of its components.`},
+		"KitDiscount": models.FloatField{String: "Bundle Discount (%)",
+			Help: "Discount applied on the sum of the component prices to compute the price of this kit."},
+	})
+
+	h.ProductTemplate().Methods().ComputeKitBasePrice().DeclareMethod(
+		`ComputeKitBasePrice returns the price field defined by priceType for one unit of this kit in
+		its default unit of measure, computed from the same price of its components. The bundle
+		discount is applied on all prices but the cost. The prices of the components are read for the
+		company given by the 'force_company' context key, or the current user's company.`,
+		func(rs m.ProductTemplateSet, priceType models.FieldNamer) float64 {
+			rs.EnsureOne()
+			var price float64
+			for _, line := range rs.KitLines().Records() {
+				price += line.ProductQty() * line.Product().PriceCompute(priceType, h.ProductUom().NewSet(rs.Env()),
+					h.Currency().NewSet(rs.Env()), h.Company().NewSet(rs.Env()))
+			}
+			if priceType.FieldName() == q.ProductProduct().StandardPrice().FieldName() {
+				return price
+			}
+			return price * (1 - rs.KitDiscount()/100)
+		})
+
+	h.ProductTemplate().Methods().ComputeKitCost().DeclareMethod(
+		`ComputeKitCost returns the cost of one unit of this kit in its default unit of measure,
+		computed from the cost of its components.`,
+		func(rs m.ProductTemplateSet) float64 {
+			return rs.ComputeKitBasePrice(q.ProductProduct().StandardPrice())
+		})
+
+	h.ProductTemplate().Methods().ComputeKitListPrice().DeclareMethod(
+		`ComputeKitListPrice returns the sale price of one unit of this kit in its default unit of measure,
+		that is the sum of the sale prices of its components minus the bundle discount.`,
+		func(rs m.ProductTemplateSet) float64 {
+			return rs.ComputeKitBasePrice(q.ProductProduct().ListPrice())
+		})
+
+	h.ProductTemplate().Methods().UpdateKitPrices().DeclareMethod(
+		`UpdateKitPrices updates the cost of the kits of this set from their components, as well as
+		their sale price if it is computed from the components. Kits containing these kits are
+		updated in turn.`,
+		func(rs m.ProductTemplateSet) {
+			for _, tmpl := range rs.Records() {
+				if !tmpl.IsKit() {
+					continue
+				}
+				tmpl.ProductVariants().SetStandardPrice(tmpl.ComputeKitCost())
+				if tmpl.KitPricing() {
+					tmpl.SetListPrice(tmpl.ComputeKitListPrice())
+				}
+			}
+		})
+
+	h.ProductProduct().Methods().ParentKits().DeclareMethod(
+		`ParentKits returns the kits that have one of the products of this set as component.`,
+		func(rs m.ProductProductSet) m.ProductTemplateSet {
+			if rs.IsEmpty() {
+				return h.ProductTemplate().NewSet(rs.Env())
+			}
+			return h.ProductTemplate().Search(rs.Env(),
+				q.ProductTemplate().IsKit().Equals(true).
+					And().KitLinesFilteredOn(q.ProductKitLine().Product().In(rs)))
+		})
+
+	h.ProductProduct().Methods().Write().Extend("",
+		func(rs m.ProductProductSet, vals m.ProductProductData) bool {
+			res := rs.Super().Write(vals)
+			if vals.HasStandardPrice() || vals.HasListPrice() || vals.HasListPriceOverride() || vals.HasVariantListPrice() {
+				rs.ParentKits().UpdateKitPrices()
+			}
+			return res
+		})
+
+	h.ProductTemplate().Methods().Write().Extend("",
+		func(rs m.ProductTemplateSet, vals m.ProductTemplateData) bool {
+			res := rs.Super().Write(vals)
+			if vals.HasIsKit() || vals.HasKitPricing() || vals.HasKitDiscount() {
+				rs.UpdateKitPrices()
+			}
+			if vals.HasListPrice() {
+				rs.ProductVariants().ParentKits().UpdateKitPrices()
+			}
+			return res
+		})
+
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"testing"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKits(t *testing.T) {
+	Convey("Testing kits", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			ptd.product1.SetStandardPrice(10)
+			ptd.product1.SetListPrice(20)
+			ptd.product3.SetStandardPrice(120)
+			ptd.product3.SetListPrice(240)
+			kitTmpl := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+				SetName("Stone Kit").
+				SetUom(ptd.uomUnit).
+				SetUomPo(ptd.uomUnit).
+				SetIsKit(true).
+				SetKitPricing(true).
+				SetKitDiscount(10))
+			h.ProductKitLine().Create(env, h.ProductKitLine().NewData().
+				SetKitTmpl(kitTmpl).
+				SetProduct(ptd.product1).
+				SetQuantity(2))
+			h.ProductKitLine().Create(env, h.ProductKitLine().NewData().
+				SetKitTmpl(kitTmpl).
+				SetProduct(ptd.product3).
+				SetQuantity(6).
+				SetUom(ptd.uomUnit))
+			kit := kitTmpl.ProductVariant()
+			noPartner := h.Partner().NewSet(env)
+			noUom := h.ProductUom().NewSet(env)
+			Convey("Kit cost and price should be computed from the components", func() {
+				So(kit.StandardPrice(), ShouldAlmostEqual, 80, 0.01)
+				So(kitTmpl.ListPrice(), ShouldAlmostEqual, 144, 0.01)
+				ptd.product1.SetStandardPrice(15)
+				ptd.product1.SetListPrice(30)
+				So(kit.StandardPrice(), ShouldAlmostEqual, 90, 0.01)
+				So(kitTmpl.ListPrice(), ShouldAlmostEqual, 162, 0.01)
+				So(kit.PriceCompute(q.ProductProduct().StandardPrice(), ptd.uomDozen,
+					h.Currency().NewSet(env), h.Company().NewSet(env)), ShouldAlmostEqual, 1080, 0.01)
+			})
+			Convey("Pricelists should apply their rules on the prices of the components of kits", func() {
+				pricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("Kit pricelist"))
+				globalRule := h.ProductPricelistItem().Create(env, h.ProductPricelistItem().NewData().
+					SetPricelist(pricelist).
+					SetComputePrice("percentage").
+					SetBase("ListPrice").
+					SetPercentPrice(20).
+					SetAppliedOn("3_global"))
+				price, rule := pricelist.ComputePriceRule(kit, 1, noPartner, dates.Date{}, noUom)
+				So(price, ShouldAlmostEqual, 115.2, 0.01)
+				So(rule.Equals(globalRule), ShouldBeTrue)
+				price, _ = pricelist.ComputePriceRule(kit, 1, noPartner, dates.Date{}, ptd.uomDozen)
+				So(price, ShouldAlmostEqual, 1382.4, 0.01)
+				costRule := h.ProductPricelistItem().Create(env, h.ProductPricelistItem().NewData().
+					SetPricelist(pricelist).
+					SetComputePrice("formula").
+					SetBase("StandardPrice").
+					SetPriceSurcharge(5).
+					SetCategory(kitTmpl.Category()).
+					SetAppliedOn("2_product_category"))
+				price, rule = pricelist.ComputePriceRule(kit, 1, noPartner, dates.Date{}, noUom)
+				So(price, ShouldAlmostEqual, 85, 0.01)
+				So(rule.Equals(costRule), ShouldBeTrue)
+				h.ProductPricelistItem().Create(env, h.ProductPricelistItem().NewData().
+					SetPricelist(pricelist).
+					SetComputePrice("fixed").
+					SetFixedPrice(100).
+					SetProductTmpl(kitTmpl).
+					SetAppliedOn("1_product"))
+				So(pricelist.GetProductPrice(kit, 1, noPartner, dates.Date{}, noUom), ShouldAlmostEqual, 100, 0.01)
+			})
+			Convey("Kits cannot contain themselves", func() {
+				So(func() {
+					h.ProductKitLine().Create(env, h.ProductKitLine().NewData().
+						SetKitTmpl(ptd.product1.ProductTmpl()).
+						SetProduct(kit))
+				}, ShouldPanic)
+			})
+			Convey("Component units should be in the category of the component", func() {
+				So(func() {
+					h.ProductKitLine().Create(env, h.ProductKitLine().NewData().
+						SetKitTmpl(kitTmpl).
+						SetProduct(ptd.product2).
+						SetUom(ptd.uomWeight))
+				}, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
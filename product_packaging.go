@@ -0,0 +1,350 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+	"math"
+
+	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-addons/product/producttypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/tools/nbutils"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.ProductPackaging().DeclareModel()
+	h.ProductPackaging().SetDefaultOrder("Sequence")
+
+	h.ProductPackaging().AddFields(map[string]models.FieldDefinition{
+		"Name": models.CharField{String: "Packaging Type", Required: true},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(1),
+			Help: "The first in the sequence is the default one."},
+		"ProductTmpl": models.Many2OneField{String: "Product", RelationModel: h.ProductTemplate(),
+			Constraint: h.ProductPackaging().Methods().CheckUom()},
+		"Product": models.Many2OneField{String: "Product Variant", RelationModel: h.ProductProduct(),
+			OnDelete: models.Cascade, Constraint: h.ProductPackaging().Methods().CheckProduct(),
+			Help: "When this field is filled in, the packaging will only apply to the variant."},
+		"Qty": models.FloatField{String: "Quantity per Package",
+			Help: "The total number of products you can have per pallet or box."},
+		"Uom": models.Many2OneField{String: "Unit of Measure", RelationModel: h.ProductUom(),
+			Constraint: h.ProductPackaging().Methods().CheckUom(),
+			Help: `Unit of measure in which the quantity per package is expressed.
+Keep empty to use the default unit of measure of the product.`},
+		"Barcode": models.CharField{NoCopy: true, Constraint: h.ProductPackaging().Methods().CheckBarcode(),
+			Help: "GTIN-14 (or GTIN-8/12/13) barcode of this packaging level."},
+		"Parent": models.Many2OneField{String: "Contained In", RelationModel: h.ProductPackaging(),
+			Constraint: h.ProductPackaging().Methods().CheckParent(),
+			Help:       "Packaging in which this packaging is put, e.g. the pallet in which this box is stacked."},
+		"Children": models.One2ManyField{String: "Contained Packagings", RelationModel: h.ProductPackaging(),
+			ReverseFK: "Parent", JSON: "child_ids"},
+		"ParentQty": models.FloatField{String: "Packages per Parent",
+			Help: "The number of packages of this packaging contained in one package of the parent packaging."},
+		"PackagingLength": models.FloatField{String: "Length", Help: "The outer length of the package in m."},
+		"Width":           models.FloatField{Help: "The outer width of the package in m."},
+		"Height":          models.FloatField{Help: "The outer height of the package in m."},
+		"Volume": models.FloatField{Compute: h.ProductPackaging().Methods().ComputeVolume(),
+			Depends: []string{"PackagingLength", "Width", "Height"},
+			Help:    "The outer volume of the package in m3."},
+		"TareWeight": models.FloatField{Digits: decimalPrecision.GetPrecision("Stock Weight"),
+			Help: "The weight of the empty packaging material in Kg (e.g. the pallet or the carton)."},
+		"ContainedQty": models.FloatField{String: "Total Quantity",
+			Compute: h.ProductPackaging().Methods().ComputeTotals(),
+			Depends: []string{"Qty", "Uom", "ProductTmpl", "Children", "Children.ParentQty", "Children.ContainedQty"},
+			Help: `The total quantity of product in one package, in the default unit of measure of the product.
+For a packaging containing other packagings, this is computed from the contained packagings.`},
+		"GrossWeight": models.FloatField{Compute: h.ProductPackaging().Methods().ComputeTotals(),
+			Depends: []string{"TareWeight", "ContainedQty", "ProductTmpl", "ProductTmpl.Weight", "Product", "Product.Weight",
+				"Children", "Children.ParentQty", "Children.GrossWeight"},
+			Digits: decimalPrecision.GetPrecision("Stock Weight"),
+			Help:   "The weight of one full package in Kg, including the packaging material."},
+	})
+
+	h.ProductPackaging().AddSQLConstraint("BarcodeUniq", "unique(barcode)", "A barcode can only be assigned to one packaging !")
+
+	h.ProductPackaging().Methods().CheckUom().DeclareMethod(
+		`CheckUom checks that the unit of measure of this packaging is in the same category
+		as the unit of measure of its product.`,
+		func(rs m.ProductPackagingSet) {
+			for _, packaging := range rs.Records() {
+				if packaging.Uom().IsEmpty() || packaging.ProductTmpl().IsEmpty() {
+					continue
+				}
+				if !packaging.Uom().Category().Equals(packaging.ProductTmpl().Uom().Category()) {
+					log.Panic(rs.T("Error: The unit of measure of a packaging must be in the same category as the unit of measure of the product."))
+				}
+			}
+		})
+
+	h.ProductPackaging().Methods().CheckBarcode().DeclareMethod(
+		`CheckBarcode panics if the barcode of this packaging is not a valid GTIN.`,
+		func(rs m.ProductPackagingSet) {
+			for _, packaging := range rs.Records() {
+				if packaging.Barcode() == "" {
+					continue
+				}
+				if !isValidGTIN(packaging.Barcode()) {
+					log.Panic(rs.T("Error: %s is not a valid GTIN barcode.", packaging.Barcode()))
+				}
+			}
+		})
+
+	h.ProductPackaging().Methods().CheckProduct().DeclareMethod(
+		`CheckProduct panics if the variant of this packaging is not a variant of its product template.`,
+		func(rs m.ProductPackagingSet) {
+			for _, packaging := range rs.Records() {
+				if packaging.Product().IsEmpty() {
+					continue
+				}
+				if !packaging.Product().ProductTmpl().Equals(packaging.ProductTmpl()) {
+					log.Panic(rs.T("Error ! The variant of a packaging must belong to the product of the packaging."))
+				}
+			}
+		})
+
+	h.ProductPackaging().Methods().Create().Extend("",
+		func(rs m.ProductPackagingSet, data m.ProductPackagingData) m.ProductPackagingSet {
+			if data.HasProduct() && !data.HasProductTmpl() {
+				data.SetProductTmpl(data.Product().ProductTmpl())
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.ProductPackaging().Methods().CheckParent().DeclareMethod(
+		`CheckParent panics if there is a recursion in the packaging nesting or if
+		a packaging is contained in a packaging of another product.`,
+		func(rs m.ProductPackagingSet) {
+			if !rs.CheckRecursion() {
+				log.Panic(rs.T("Error ! You cannot create recursive packagings."))
+			}
+			for _, packaging := range rs.Records() {
+				if packaging.Parent().IsEmpty() {
+					continue
+				}
+				if !packaging.Parent().ProductTmpl().Equals(packaging.ProductTmpl()) {
+					log.Panic(rs.T("Error ! A packaging can only be contained in a packaging of the same product."))
+				}
+				if !packaging.Parent().Product().IsEmpty() && !packaging.Parent().Product().Equals(packaging.Product()) {
+					log.Panic(rs.T("Error ! A packaging can only be contained in a packaging of the same variant."))
+				}
+			}
+		})
+
+	h.ProductPackaging().Methods().ComputeVolume().DeclareMethod(
+		`ComputeVolume computes the outer volume of this packaging from its dimensions`,
+		func(rs m.ProductPackagingSet) m.ProductPackagingData {
+			return h.ProductPackaging().NewData().
+				SetVolume(rs.PackagingLength() * rs.Width() * rs.Height())
+		})
+
+	h.ProductPackaging().Methods().ComputeTotals().DeclareMethod(
+		`ComputeTotals computes the total quantity of product and the gross weight of one package.
+		A packaging that contains other packagings is the sum of its contents.`,
+		func(rs m.ProductPackagingSet) m.ProductPackagingData {
+			var qty, weight float64
+			if rs.Children().IsEmpty() {
+				qty = rs.ProductQty(h.ProductUom().NewSet(rs.Env()))
+				weight = qty * rs.ProductTmpl().Weight()
+				if !rs.Product().IsEmpty() {
+					weight = qty * rs.Product().Weight()
+				}
+			}
+			for _, child := range rs.Children().Records() {
+				qty += child.ParentQty() * child.ContainedQty()
+				weight += child.ParentQty() * child.GrossWeight()
+			}
+			return h.ProductPackaging().NewData().
+				SetContainedQty(qty).
+				SetGrossWeight(weight + rs.TareWeight())
+		})
+
+	h.ProductPackaging().Methods().ProductQty().DeclareMethod(
+		`ProductQty returns the quantity of product contained in one package of this packaging,
+		expressed in the given uom. If uom is empty, the default UoM of the product is used.`,
+		func(rs m.ProductPackagingSet, uom m.ProductUomSet) float64 {
+			rs.EnsureOne()
+			fromUom := rs.Uom()
+			if fromUom.IsEmpty() {
+				fromUom = rs.ProductTmpl().Uom()
+			}
+			if uom.IsEmpty() {
+				uom = rs.ProductTmpl().Uom()
+			}
+			if fromUom.IsEmpty() || fromUom.Equals(uom) {
+				return rs.Qty()
+			}
+			return fromUom.ComputeQuantity(rs.Qty(), uom, false)
+		})
+
+	h.ProductPackaging().Methods().ContainedProductQty().DeclareMethod(
+		`ContainedProductQty returns the total quantity of product in one package of this packaging,
+		including the contents of the packagings it contains, expressed in the given uom. If uom is
+		empty, the default UoM of the product is used.`,
+		func(rs m.ProductPackagingSet, uom m.ProductUomSet) float64 {
+			rs.EnsureOne()
+			productUom := rs.ProductTmpl().Uom()
+			if uom.IsEmpty() || productUom.IsEmpty() || productUom.Equals(uom) {
+				return rs.ContainedQty()
+			}
+			return productUom.ComputeQuantity(rs.ContainedQty(), uom, false)
+		})
+
+	h.ProductProduct().Methods().AvailablePackagings().DeclareMethod(
+		`AvailablePackagings returns the packagings of this product containing a positive quantity
+		of product, directly or through the packagings they contain, ordered by sequence.
+
+		Packagings specific to this variant are preferred: a packaging of the template is
+		only returned if this variant has no specific packaging with the same name.`,
+		func(rs m.ProductProductSet) m.ProductPackagingSet {
+			rs.EnsureOne()
+			variantNames := make(map[string]bool)
+			packagings := rs.ProductTmpl().Packagings().Filtered(func(r m.ProductPackagingSet) bool {
+				if r.ContainedQty() <= 0 || (!r.Product().IsEmpty() && !r.Product().Equals(rs)) {
+					return false
+				}
+				if !r.Product().IsEmpty() {
+					variantNames[r.Name()] = true
+				}
+				return true
+			})
+			return packagings.Filtered(func(r m.ProductPackagingSet) bool {
+				return !r.Product().IsEmpty() || !variantNames[r.Name()]
+			}).SortedByField(q.ProductPackaging().Sequence(), false)
+		})
+
+	h.ProductProduct().Methods().GetPackaging().DeclareMethod(
+		`GetPackaging returns the packaging of this product with the given name, preferring
+		the packaging specific to this variant over the one of the template. It returns an
+		empty set if there is no such packaging.`,
+		func(rs m.ProductProductSet, name string) m.ProductPackagingSet {
+			rs.EnsureOne()
+			res := h.ProductPackaging().NewSet(rs.Env())
+			for _, packaging := range rs.ProductTmpl().Packagings().Records() {
+				if packaging.Name() != name {
+					continue
+				}
+				switch {
+				case packaging.Product().Equals(rs):
+					return packaging
+				case packaging.Product().IsEmpty() && res.IsEmpty():
+					res = packaging
+				}
+			}
+			return res
+		})
+
+	h.ProductProduct().Methods().SplitIntoPackages().DeclareMethod(
+		`SplitIntoPackages suggests how to ship the given quantity of this product expressed in uom
+		with its available packagings. The biggest packagings are filled first, packagings with the same
+		content being taken in sequence order.
+
+		It returns the number of full packages of each used packaging and the remaining quantity that
+		does not fill a package, expressed in uom. If uom is empty, the product's UoM is used.
+		For instance, 125 units with a box of 24 returns 5 boxes and 5 units.`,
+		func(rs m.ProductProductSet, qty float64, uom m.ProductUomSet) ([]producttypes.PackagingQuantity, float64) {
+			rs.EnsureOne()
+			if uom.IsEmpty() {
+				uom = rs.Uom()
+			}
+			packagings := rs.AvailablePackagings().Sorted(func(rs1, rs2 m.ProductPackagingSet) bool {
+				qty1, qty2 := rs1.ContainedProductQty(uom), rs2.ContainedProductQty(uom)
+				if qty1 != qty2 {
+					return qty1 > qty2
+				}
+				return rs1.Sequence() < rs2.Sequence()
+			})
+			var res []producttypes.PackagingQuantity
+			remaining := qty
+			for _, packaging := range packagings.Records() {
+				size := packaging.ContainedProductQty(uom)
+				if size <= 0 {
+					continue
+				}
+				packages := math.Floor(remaining / size)
+				if nbutils.Compare(remaining, (packages+1)*size, uom.Rounding()) >= 0 {
+					packages++
+				}
+				if packages <= 0 {
+					continue
+				}
+				res = append(res, producttypes.PackagingQuantity{
+					PackagingID: packaging.ID(),
+					Packages:    packages,
+					Qty:         packages * size,
+				})
+				remaining = nbutils.Round(remaining-packages*size, uom.Rounding())
+			}
+			return res, remaining
+		})
+
+	h.ProductProduct().Methods().PackagesToQuantity().DeclareMethod(
+		`PackagesToQuantity returns the quantity of this product expressed in uom contained
+		in the given number of packages of packaging. If uom is empty, the product's UoM is used.`,
+		func(rs m.ProductProductSet, packaging m.ProductPackagingSet, packages float64, uom m.ProductUomSet) float64 {
+			rs.EnsureOne()
+			if uom.IsEmpty() {
+				uom = rs.Uom()
+			}
+			return packages * packaging.ContainedProductQty(uom)
+		})
+
+	h.ProductProduct().Methods().RoundToPackages().DeclareMethod(
+		`RoundToPackages rounds up the given quantity of this product expressed in uom so that
+		it fills full packages of the given packaging. If packaging is empty, the default packaging
+		of the product (i.e. the first in sequence) is used. If uom is empty, the product's UoM is used.
+
+		The quantity is returned unchanged if the product has no packaging.`,
+		func(rs m.ProductProductSet, qty float64, uom m.ProductUomSet, packaging m.ProductPackagingSet) float64 {
+			rs.EnsureOne()
+			if uom.IsEmpty() {
+				uom = rs.Uom()
+			}
+			if packaging.IsEmpty() {
+				packagings := rs.AvailablePackagings()
+				if packagings.IsEmpty() {
+					return qty
+				}
+				packaging = packagings.Records()[0]
+			}
+			size := packaging.ContainedProductQty(uom)
+			if size <= 0 {
+				return qty
+			}
+			packages := math.Floor(qty / size)
+			if nbutils.Compare(qty, packages*size, uom.Rounding()) > 0 {
+				packages++
+			}
+			return packages * size
+		})
+
+}
+
+// isValidGTIN returns true if the given code is a GTIN-8, GTIN-12,
+// GTIN-13 or GTIN-14 with a valid check digit.
+func isValidGTIN(code string) bool {
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+	var sum int
+	for i := len(code) - 1; i >= 0; i-- {
+		if code[i] < '0' || code[i] > '9' {
+			return false
+		}
+		if i == len(code)-1 {
+			continue
+		}
+		digit := int(code[i] - '0')
+		if (len(code)-1-i)%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	return (10-sum%10)%10 == int(code[len(code)-1]-'0')
+}
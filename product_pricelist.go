@@ -118,11 +118,20 @@ func init() {
 					qtyInProductUom = qtyUom.ComputeQuantity(quantity, product.Uom(), true)
 				}
 			}
+			// PriceCompute prices kits from their components, so that pricelist rules apply on
+			// the prices of the components of kits priced from their components.
+			basePrice := func(priceType models.FieldNamer) float64 {
+				return product.PriceCompute(priceType, h.ProductUom().NewSet(rs.Env()),
+					h.Currency().NewSet(rs.Env()), h.Company().NewSet(rs.Env()))
+			}
 			priceUom := qtyUom
-			price = product.PriceCompute(q.ProductProduct().ListPrice(),
-				h.ProductUom().NewSet(rs.Env()), h.Currency().NewSet(rs.Env()), h.Company().NewSet(rs.Env()))
+			price = basePrice(q.ProductProduct().ListPrice())
 
 			for _, rule := range items.Records() {
+				if rule.RentalOnly() {
+					// Rental rules are applied by ApplyRentalRule on rental prices
+					continue
+				}
 				if rule.MinQuantity() != 0 && qtyInProductUom < rule.MinQuantity() {
 					continue
 				}
@@ -150,8 +159,7 @@ func init() {
 				} else {
 					// if base option is public price take sale price else cost price of product
 					// price_compute returns the price in the context UoM, i.e. QtyUom
-					price = product.PriceCompute(models.FieldName(rule.Base()), h.ProductUom().NewSet(rs.Env()),
-						h.Currency().NewSet(rs.Env()), h.Company().NewSet(rs.Env()))
+					price = basePrice(models.FieldName(rule.Base()))
 				}
 				convertToPriceUom := func(p float64) float64 {
 					return product.Uom().ComputePrice(p, priceUom)
@@ -11,6 +11,7 @@ import (
 	"github.com/hexya-erp/hexya/src/models/types"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -115,15 +116,121 @@ func TestProductPriceList(t *testing.T) {
 					WithKey("partner_id", partner4.ID())
 				ipadMini = ipadMini.WithNewContext(context)
 				partner := partner4.WithNewContext(context)
-				So(ipadMini.SelectSeller(partner, 1, dates.Date{}, h.ProductUom().NewSet(env)).Price(), ShouldAlmostEqual, 790, 0.01)
+				So(ipadMini.SelectSeller(partner, 1, dates.Date{}, h.ProductUom().NewSet(env), "").Price(), ShouldAlmostEqual, 790, 0.01)
 
 				context = context.
 					WithKey("quantity", 3)
 				ipadMini = ipadMini.WithNewContext(context)
 				partner = partner4.WithNewContext(context)
-				So(ipadMini.SelectSeller(partner, 3, dates.Date{}, h.ProductUom().NewSet(env)).Price(), ShouldAlmostEqual, 785, 0.01)
+				So(ipadMini.SelectSeller(partner, 3, dates.Date{}, h.ProductUom().NewSet(env), "").Price(), ShouldAlmostEqual, 785, 0.01)
 
 			})
 		}), ShouldBeNil)
 	})
 }
+
+func TestVariantListPrice(t *testing.T) {
+	Convey("Testing fixed variant sale prices", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			ptd.template7.SetListPrice(100)
+			h.ProductAttributePrice().Create(env, h.ProductAttributePrice().NewData().
+				SetProductTmpl(ptd.template7).
+				SetValue(ptd.prodAttr1V1).
+				SetPriceExtra(10))
+			noUom := h.ProductUom().NewSet(env)
+			noCurrency := h.Currency().NewSet(env)
+			noCompany := h.Company().NewSet(env)
+			So(ptd.product71.LstPrice(), ShouldAlmostEqual, 110, 0.01)
+			ptd.product71.Write(h.ProductProduct().NewData().
+				SetListPriceOverride(true).
+				SetVariantListPrice(150))
+			Convey("Fixed prices should replace the product price and the extras", func() {
+				So(ptd.product71.LstPrice(), ShouldAlmostEqual, 150, 0.01)
+				So(ptd.product71.PriceCompute(q.ProductProduct().ListPrice(), noUom, noCurrency, noCompany), ShouldAlmostEqual, 150, 0.01)
+				So(ptd.product71.PriceCompute(q.ProductProduct().ListPrice(), ptd.uomDozen, noCurrency, noCompany), ShouldAlmostEqual, 1800, 0.01)
+				So(ptd.product72.LstPrice(), ShouldAlmostEqual, 100, 0.01)
+			})
+			Convey("Pricelists based on the sale price should use fixed prices", func() {
+				pricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("Variant pricelist"))
+				h.ProductPricelistItem().Create(env, h.ProductPricelistItem().NewData().
+					SetPricelist(pricelist).
+					SetComputePrice("formula").
+					SetBase("ListPrice").
+					SetPriceDiscount(10).
+					SetAppliedOn("3_global"))
+				So(pricelist.GetProductPrice(ptd.product71, 1, h.Partner().NewSet(env), dates.Date{}, noUom), ShouldAlmostEqual, 135, 0.01)
+				So(pricelist.GetProductPrice(ptd.product72, 1, h.Partner().NewSet(env), dates.Date{}, noUom), ShouldAlmostEqual, 90, 0.01)
+			})
+			Convey("Setting the sale price should update the fixed price only", func() {
+				ptd.product71.SetLstPrice(160)
+				So(ptd.product71.VariantListPrice(), ShouldAlmostEqual, 160, 0.01)
+				So(ptd.template7.ListPrice(), ShouldAlmostEqual, 100, 0.01)
+				ptd.product72.SetLstPrice(120)
+				So(ptd.template7.ListPrice(), ShouldAlmostEqual, 120, 0.01)
+				So(ptd.product71.LstPrice(), ShouldAlmostEqual, 160, 0.01)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestPercentagePriceExtra(t *testing.T) {
+	Convey("Testing percentage attribute price extras", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			ptd.template7.SetListPrice(100)
+			material := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+				SetName("Material"))
+			leather := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetName("Leather").
+				SetAttribute(material))
+			ptd.product71.SetAttributeValues(ptd.prodAttr1V1.Union(leather))
+			redPrice := h.ProductAttributePrice().Create(env, h.ProductAttributePrice().NewData().
+				SetProductTmpl(ptd.template7).
+				SetValue(ptd.prodAttr1V1).
+				SetSequence(1).
+				SetPriceExtra(10))
+			leatherPrice := h.ProductAttributePrice().Create(env, h.ProductAttributePrice().NewData().
+				SetProductTmpl(ptd.template7).
+				SetValue(leather).
+				SetSequence(2).
+				SetExtraType("percentage").
+				SetPricePercent(20))
+			Convey("Percentages should apply to the price with the previous extras", func() {
+				So(ptd.product71.LstPrice(), ShouldAlmostEqual, 132, 0.01)
+				So(ptd.product71.PriceExtra(), ShouldAlmostEqual, 32, 0.01)
+				So(ptd.product72.LstPrice(), ShouldAlmostEqual, 100, 0.01)
+			})
+			Convey("Extras should be applied in sequence order", func() {
+				leatherPrice.SetSequence(0)
+				So(ptd.product71.LstPrice(), ShouldAlmostEqual, 130, 0.01)
+				So(ptd.product71.PriceExtra(), ShouldAlmostEqual, 30, 0.01)
+				redPrice.SetSequence(0)
+				leatherPrice.SetSequence(0)
+				So(ptd.product71.LstPrice(), ShouldAlmostEqual, 132, 0.01)
+			})
+			Convey("Setting the sale price should update the product price", func() {
+				ptd.product71.SetLstPrice(156)
+				So(ptd.template7.ListPrice(), ShouldAlmostEqual, 120, 0.01)
+				So(ptd.product71.LstPrice(), ShouldAlmostEqual, 156, 0.01)
+				So(ptd.product72.LstPrice(), ShouldAlmostEqual, 120, 0.01)
+			})
+			Convey("Variant prices should show and edit the extra of its type", func() {
+				tmplLeather := leather.WithContext("active_id", ptd.template7.ID())
+				So(tmplLeather.ExtraType(), ShouldEqual, "percentage")
+				So(tmplLeather.PricePercent(), ShouldEqual, 20)
+				tmplLeather.SetPricePercent(25)
+				So(leatherPrice.PricePercent(), ShouldEqual, 25)
+				So(ptd.product71.LstPrice(), ShouldAlmostEqual, 137.5, 0.01)
+				tmplLeather.SetExtraType("fixed")
+				tmplLeather.SetPriceExtra(15)
+				So(leatherPrice.ExtraType(), ShouldEqual, "fixed")
+				So(ptd.product71.LstPrice(), ShouldAlmostEqual, 125, 0.01)
+			})
+			Convey("Percentages of -100% or less should not be allowed", func() {
+				So(func() { leatherPrice.SetPricePercent(-100) }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
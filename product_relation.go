@@ -0,0 +1,175 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.ProductRelation().DeclareModel()
+	h.ProductRelation().SetDefaultOrder("Sequence", "ID")
+
+	h.ProductRelation().AddFields(map[string]models.FieldDefinition{
+		"RelationType": models.SelectionField{String: "Type", Selection: types.Selection{
+			"substitute":  "Substitute",
+			"alternative": "Alternative",
+			"accessory":   "Accessory",
+			"upsell":      "Upsell",
+			"cross_sell":  "Cross-Sell",
+		}, Required: true, Default: models.DefaultValue("alternative"),
+			Help: `Substitute: the related product can replace this product when it is not available.
+Alternative: the related product can be proposed instead of this product. Alternatives are symmetric.
+Accessory: the related product is an accessory of this product.
+Upsell: the related product is a more expensive version of this product.
+Cross-Sell: the related product is usually sold with this product.`},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(10)},
+		"ProductTmpl": models.Many2OneField{String: "Product", RelationModel: h.ProductTemplate(),
+			Required: true, OnDelete: models.Cascade, Index: true,
+			Constraint: h.ProductRelation().Methods().CheckProducts()},
+		"Product": models.Many2OneField{String: "Product Variant", RelationModel: h.ProductProduct(),
+			OnDelete: models.Cascade, Constraint: h.ProductRelation().Methods().CheckProducts(),
+			Help: "When this field is filled in, the relation will only apply to the variant."},
+		"RelatedTmpl": models.Many2OneField{String: "Related Product", RelationModel: h.ProductTemplate(),
+			Required: true, OnDelete: models.Cascade, Index: true, JSON: "related_tmpl_id",
+			Constraint: h.ProductRelation().Methods().CheckProducts()},
+		"RelatedProduct": models.Many2OneField{String: "Related Variant", RelationModel: h.ProductProduct(),
+			OnDelete: models.Cascade, Constraint: h.ProductRelation().Methods().CheckProducts(),
+			Help: "When this field is filled in, only this variant of the related product is proposed."},
+		"Ratio": models.FloatField{Default: models.DefaultValue(1.0),
+			Help: `Quantity of the related product to use for one unit of this product,
+both expressed in the default unit of measure of the products.`},
+		"DateStart": models.DateField{String: "Start Date", Help: "Start date for this relation"},
+		"DateEnd":   models.DateField{String: "End Date", Help: "End date for this relation"},
+	})
+
+	h.ProductRelation().Methods().CheckProducts().DeclareMethod(
+		`CheckProducts checks that the variants of this relation belong to their templates
+		and that a product is not related to itself.`,
+		func(rs m.ProductRelationSet) {
+			for _, relation := range rs.Records() {
+				if !relation.Product().IsEmpty() && !relation.Product().ProductTmpl().Equals(relation.ProductTmpl()) {
+					log.Panic(rs.T("Error: The variant of a product relation must be a variant of its product."))
+				}
+				if !relation.RelatedProduct().IsEmpty() && !relation.RelatedProduct().ProductTmpl().Equals(relation.RelatedTmpl()) {
+					log.Panic(rs.T("Error: The related variant must be a variant of the related product."))
+				}
+				if !relation.ProductTmpl().Equals(relation.RelatedTmpl()) {
+					continue
+				}
+				if relation.Product().IsEmpty() || relation.RelatedProduct().IsEmpty() || relation.Product().Equals(relation.RelatedProduct()) {
+					log.Panic(rs.T("Error: A product cannot be related to itself."))
+				}
+			}
+		})
+
+	h.ProductRelation().Methods().Create().Extend("",
+		func(rs m.ProductRelationSet, data m.ProductRelationData) m.ProductRelationSet {
+			if data.HasProduct() && !data.HasProductTmpl() {
+				data.SetProductTmpl(data.Product().ProductTmpl())
+			}
+			if data.HasRelatedProduct() && !data.HasRelatedTmpl() {
+				data.SetRelatedTmpl(data.RelatedProduct().ProductTmpl())
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.ProductRelation().Methods().CheckDate().DeclareMethod(
+		`CheckDate returns true if this relation is valid at the given date.`,
+		func(rs m.ProductRelationSet, date dates.Date) bool {
+			rs.EnsureOne()
+			if !rs.DateStart().IsZero() && rs.DateStart().Greater(date) {
+				return false
+			}
+			if !rs.DateEnd().IsZero() && rs.DateEnd().Lower(date) {
+				return false
+			}
+			return true
+		})
+
+	h.ProductTemplate().AddFields(map[string]models.FieldDefinition{
+		"Relations": models.One2ManyField{String: "Related Products", RelationModel: h.ProductRelation(),
+			ReverseFK: "ProductTmpl", JSON: "relation_ids"},
+	})
+
+	h.ProductProduct().Methods().GetRelations().DeclareMethod(
+		`GetRelations returns the relations of the given type of this product that are valid at the given date,
+		including the relations of its template. If date is zero, today is used.
+
+		Since alternatives are symmetric, the alternative relations pointing to this product are
+		also returned for the 'alternative' type.`,
+		func(rs m.ProductProductSet, relationType string, date dates.Date) m.ProductRelationSet {
+			rs.EnsureOne()
+			if date.IsZero() {
+				date = dates.Today()
+			}
+			cond := q.ProductRelation().ProductTmpl().Equals(rs.ProductTmpl()).
+				AndCond(q.ProductRelation().Product().IsNull().Or().Product().Equals(rs))
+			if relationType == "alternative" {
+				cond = cond.OrCond(q.ProductRelation().RelatedTmpl().Equals(rs.ProductTmpl()).
+					AndCond(q.ProductRelation().RelatedProduct().IsNull().Or().RelatedProduct().Equals(rs)))
+			}
+			relations := h.ProductRelation().Search(rs.Env(),
+				q.ProductRelation().RelationType().Equals(relationType).AndCond(cond))
+			return relations.Filtered(func(r m.ProductRelationSet) bool {
+				return r.CheckDate(date)
+			})
+		})
+
+	h.ProductProduct().Methods().GetRelatedProducts().DeclareMethod(
+		`GetRelatedProducts returns the variants related to this product with the given relation type
+		at the given date, ordered by the sequence of the relations. If date is zero, today is used.
+
+		Archived products and products that cannot be sold are excluded.`,
+		func(rs m.ProductProductSet, relationType string, date dates.Date) m.ProductProductSet {
+			rs.EnsureOne()
+			res := h.ProductProduct().NewSet(rs.Env())
+			for _, relation := range rs.GetRelations(relationType, date).Records() {
+				forward := relation.ProductTmpl().Equals(rs.ProductTmpl()) &&
+					(relation.Product().IsEmpty() || relation.Product().Equals(rs))
+				candidates, candidatesTmpl := relation.RelatedProduct(), relation.RelatedTmpl()
+				if !forward {
+					candidates, candidatesTmpl = relation.Product(), relation.ProductTmpl()
+				}
+				if candidates.IsEmpty() {
+					candidates = candidatesTmpl.ProductVariants()
+				}
+				for _, product := range candidates.Records() {
+					if product.Equals(rs) || !product.Active() || !product.ProductTmpl().Active() || !product.SaleOk() {
+						continue
+					}
+					res = res.Union(product)
+				}
+			}
+			return res
+		})
+
+	h.ProductProduct().Methods().GetSubstitutes().DeclareMethod(
+		`GetSubstitutes returns the saleable active products that can replace this product at the given date.`,
+		func(rs m.ProductProductSet, date dates.Date) m.ProductProductSet {
+			return rs.GetRelatedProducts("substitute", date)
+		})
+
+	h.ProductProduct().Methods().GetAlternatives().DeclareMethod(
+		`GetAlternatives returns the saleable active products that can be proposed instead of this product
+		at the given date.`,
+		func(rs m.ProductProductSet, date dates.Date) m.ProductProductSet {
+			return rs.GetRelatedProducts("alternative", date)
+		})
+
+	h.ProductProduct().Methods().GetAccessories().DeclareMethod(
+		`GetAccessories returns the saleable active accessories of this product at the given date.`,
+		func(rs m.ProductProductSet, date dates.Date) m.ProductProductSet {
+			return rs.GetRelatedProducts("accessory", date)
+		})
+
+}
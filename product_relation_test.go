@@ -0,0 +1,62 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"testing"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProductRelations(t *testing.T) {
+	Convey("Testing product relations", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			relate := func(product, related m.ProductProductSet, relationType string) m.ProductRelationSet {
+				return h.ProductRelation().Create(env, h.ProductRelation().NewData().
+					SetProductTmpl(product.ProductTmpl()).
+					SetRelatedTmpl(related.ProductTmpl()).
+					SetRelationType(relationType))
+			}
+			Convey("Substitutes and accessories should be found", func() {
+				relate(ptd.product1, ptd.product2, "substitute")
+				relate(ptd.product1, ptd.product3, "accessory")
+				relate(ptd.product1, ptd.product4, "accessory")
+				relate(ptd.product1, ptd.product5, "accessory")
+				relate(ptd.product1, ptd.product6, "accessory").
+					SetDateEnd(dates.Today().AddDate(0, 0, -1))
+				ptd.product4.SetSaleOk(false)
+				ptd.product5.SetActive(false)
+				So(ptd.product1.GetSubstitutes(dates.Date{}).Equals(ptd.product2), ShouldBeTrue)
+				So(ptd.product1.GetAccessories(dates.Date{}).Equals(ptd.product3), ShouldBeTrue)
+				So(ptd.product1.GetAccessories(dates.Today().AddDate(0, 0, -2)).Len(), ShouldEqual, 2)
+				So(ptd.product2.GetSubstitutes(dates.Date{}).IsEmpty(), ShouldBeTrue)
+				So(ptd.product3.GetAccessories(dates.Date{}).IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Alternatives should be symmetric", func() {
+				relate(ptd.product2, ptd.product3, "alternative")
+				So(ptd.product2.GetAlternatives(dates.Date{}).Equals(ptd.product3), ShouldBeTrue)
+				So(ptd.product3.GetAlternatives(dates.Date{}).Equals(ptd.product2), ShouldBeTrue)
+			})
+			Convey("Relations can be restricted to variants", func() {
+				h.ProductRelation().Create(env, h.ProductRelation().NewData().
+					SetProduct(ptd.product71).
+					SetRelatedProduct(ptd.product72).
+					SetRelationType("upsell").
+					SetRatio(2))
+				So(ptd.product71.GetRelatedProducts("upsell", dates.Date{}).Equals(ptd.product72), ShouldBeTrue)
+				So(ptd.product72.GetRelatedProducts("upsell", dates.Date{}).IsEmpty(), ShouldBeTrue)
+				So(ptd.product71.GetRelations("upsell", dates.Date{}).Ratio(), ShouldEqual, 2)
+			})
+			Convey("A product cannot be related to itself", func() {
+				So(func() { relate(ptd.product1, ptd.product1, "alternative") }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,299 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+	"math"
+	"sort"
+
+	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-addons/product/producttypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/nbutils"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// rentalTolerance is the duration in hours under which a rental
+// is considered as fully covered by the charged periods.
+const rentalTolerance = 1e-6
+
+func init() {
+
+	h.ProductUom().Methods().CalendarHours().DeclareMethod(
+		`CalendarHours returns the length in hours of one unit of this time unit.
+
+		Since the Working Time category counts 8 hours a day, units smaller than the day are
+		converted through the hour unit, whereas the day and bigger units are converted through
+		calendar days of 24 hours.`,
+		func(rs m.ProductUomSet) float64 {
+			rs.EnsureOne()
+			day := h.ProductUom().NewSet(rs.Env()).GetRecord("product_product_uom_day")
+			if !rs.Category().Equals(day.Category()) {
+				log.Panic(rs.T("Unit of measure %s is not a time unit", rs.Name()))
+			}
+			if rs.Factor() > day.Factor() {
+				hour := h.ProductUom().NewSet(rs.Env()).GetRecord("product_product_uom_hour")
+				return rs.ComputeQuantity(1, hour, false)
+			}
+			return 24 * rs.ComputeQuantity(1, day, false)
+		})
+
+	h.ProductRentalRate().DeclareModel()
+	h.ProductRentalRate().SetDefaultOrder("ProductTmpl", "Price")
+
+	h.ProductRentalRate().AddFields(map[string]models.FieldDefinition{
+		"ProductTmpl": models.Many2OneField{String: "Product", RelationModel: h.ProductTemplate(),
+			Required: true, OnDelete: models.Cascade, Index: true,
+			Constraint: h.ProductRentalRate().Methods().CheckRate()},
+		"Product": models.Many2OneField{String: "Product Variant", RelationModel: h.ProductProduct(),
+			OnDelete: models.Cascade, Constraint: h.ProductRentalRate().Methods().CheckRate(),
+			Help: `When this field is filled in, the rate will only apply to the variant and
+replaces the rates of the product with the same period.`},
+		"Uom": models.Many2OneField{String: "Period", RelationModel: h.ProductUom(), Required: true,
+			Filter:     q.ProductUom().CategoryFilteredOn(q.ProductUomCategory().HexyaExternalID().Equals("product_uom_categ_wtime")),
+			Constraint: h.ProductRentalRate().Methods().CheckRate()},
+		"Price": models.FloatField{Digits: decimalPrecision.GetPrecision("Product Price"), Required: true,
+			Help: "Rental price for one period."},
+		"MinDuration": models.IntegerField{String: "Minimum Duration", Default: models.DefaultValue(1),
+			Required: true, Constraint: h.ProductRentalRate().Methods().CheckRate(),
+			Help: "Minimum number of periods charged when this rate is used."},
+	})
+
+	h.ProductRentalRate().Methods().CheckRate().DeclareMethod(
+		`CheckRate checks that the period of this rate is a time unit, that its minimum
+		duration is positive and that its variant belongs to its product.`,
+		func(rs m.ProductRentalRateSet) {
+			for _, rate := range rs.Records() {
+				if !rate.Uom().Category().Equals(h.ProductUomCategory().NewSet(rs.Env()).GetRecord("product_uom_categ_wtime")) {
+					log.Panic(rs.T("Error: The period of a rental rate must be a time unit."))
+				}
+				if rate.MinDuration() < 1 {
+					log.Panic(rs.T("Error: The minimum duration of a rental rate must be at least one period."))
+				}
+				if !rate.Product().IsEmpty() && !rate.Product().ProductTmpl().Equals(rate.ProductTmpl()) {
+					log.Panic(rs.T("Error: The variant of a rental rate must be a variant of its product."))
+				}
+			}
+		})
+
+	h.ProductRentalRate().Methods().Create().Extend("",
+		func(rs m.ProductRentalRateSet, data m.ProductRentalRateData) m.ProductRentalRateSet {
+			if data.HasProduct() && !data.HasProductTmpl() {
+				data.SetProductTmpl(data.Product().ProductTmpl())
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.ProductRentalRate().Methods().ApplicableRates().DeclareMethod(
+		`ApplicableRates returns the rental rates of the given product. Rates of the variant
+		replace the rates of its template with the same period.`,
+		func(rs m.ProductRentalRateSet, product m.ProductProductSet) m.ProductRentalRateSet {
+			product.EnsureOne()
+			rates := h.ProductRentalRate().Search(rs.Env(),
+				q.ProductRentalRate().ProductTmpl().Equals(product.ProductTmpl()).
+					AndCond(q.ProductRentalRate().Product().IsNull().Or().Product().Equals(product)))
+			variantUoms := make(map[int64]bool)
+			for _, rate := range rates.Records() {
+				if !rate.Product().IsEmpty() {
+					variantUoms[rate.Uom().ID()] = true
+				}
+			}
+			return rates.Filtered(func(r m.ProductRentalRateSet) bool {
+				return !r.Product().IsEmpty() || !variantUoms[r.Uom().ID()]
+			})
+		})
+
+	h.ProductRentalRate().Methods().ComputeRentalPeriods().DeclareMethod(
+		`ComputeRentalPeriods returns the cheapest combination of rental periods of the given product
+		covering the given duration in hours, with the total price of this combination. Each rate is
+		either not used or used for at least its minimum duration.
+
+		The combination is found by dynamic programming over the duration, so that the computation
+		time grows linearly with the duration and the number of rates.
+
+		Periods are returned from the longest to the shortest. It panics if the product has no rental rates.`,
+		func(rs m.ProductRentalRateSet, product m.ProductProductSet, hours float64) ([]producttypes.RentalPeriod, float64) {
+			rates := rs.ApplicableRates(product).Records()
+			if len(rates) == 0 {
+				log.Panic(rs.T("Product %s has no rental rates", product.Name()))
+			}
+			if hours <= rentalTolerance {
+				return nil, 0
+			}
+			// Periods are combined on a grid of whole minutes whose step is the greatest
+			// common divisor of the lengths of the periods.
+			lengths := make([]int, len(rates))
+			var step int
+			for i, rate := range rates {
+				lengths[i] = int(math.Max(1, math.Round(rate.Uom().CalendarHours()*60)))
+				step = gcd(step, lengths[i])
+			}
+			for i := range lengths {
+				lengths[i] /= step
+			}
+			target := int(math.Ceil((hours - rentalTolerance) * 60 / float64(step)))
+			indexes := make([]int, len(rates))
+			for i := range indexes {
+				indexes[i] = i
+			}
+			sort.SliceStable(indexes, func(i, j int) bool {
+				return lengths[indexes[i]] < lengths[indexes[j]]
+			})
+			// cost[c] is the price of the cheapest combination of the rates processed so far
+			// covering at least c steps, and counts[i][c] the number of periods of rate i it uses.
+			// Rates are processed from the shortest to the longest so that longer periods are
+			// preferred at equal price.
+			cost := make([]float64, target+1)
+			for c := 1; c <= target; c++ {
+				cost[c] = math.Inf(1)
+			}
+			// before returns the coverage left to reach c once steps are charged
+			before := func(c, steps int) int {
+				if c < steps {
+					return 0
+				}
+				return c - steps
+			}
+			counts := make([][]int, len(rates))
+			withRate := make([]float64, target+1)
+			for _, i := range indexes {
+				minCount := int(rates[i].MinDuration())
+				counts[i] = make([]int, target+1)
+				for c := 0; c <= target; c++ {
+					// Either the minimum duration of this rate on top of a combination without it,
+					// or one more period on top of a combination already using it.
+					withRate[c] = cost[before(c, minCount*lengths[i])] + float64(minCount)*rates[i].Price()
+					counts[i][c] = minCount
+					if c == 0 {
+						continue
+					}
+					prev := before(c, lengths[i])
+					if price := withRate[prev] + rates[i].Price(); price < withRate[c] {
+						withRate[c] = price
+						counts[i][c] = counts[i][prev] + 1
+					}
+				}
+				for c := 0; c <= target; c++ {
+					if withRate[c] > cost[c] {
+						counts[i][c] = 0
+						continue
+					}
+					cost[c] = withRate[c]
+				}
+			}
+			periods := make([]int, len(rates))
+			for c, k := target, len(indexes)-1; k >= 0; k-- {
+				i := indexes[k]
+				periods[i] = counts[i][c]
+				c = before(c, periods[i]*lengths[i])
+			}
+			var res []producttypes.RentalPeriod
+			for k := len(indexes) - 1; k >= 0; k-- {
+				i := indexes[k]
+				if periods[i] == 0 {
+					continue
+				}
+				res = append(res, producttypes.RentalPeriod{
+					RateID:  rates[i].ID(),
+					Periods: periods[i],
+					Price:   float64(periods[i]) * rates[i].Price(),
+				})
+			}
+			return res, cost[target]
+		})
+
+	h.ProductProduct().Methods().ComputeRentalPrice().DeclareMethod(
+		`ComputeRentalPrice returns the price of renting this product from start to end.
+		The price is computed from the cheapest combination of rental periods of the product.
+
+		If pricelist is not empty, the price is converted into the pricelist currency and the
+		first matching rental rule of the pricelist is applied.`,
+		func(rs m.ProductProductSet, start, end dates.DateTime, pricelist m.ProductPricelistSet) float64 {
+			rs.EnsureOne()
+			if !rs.Rental() {
+				log.Panic(rs.T("Product %s cannot be rented", rs.Name()))
+			}
+			if end.Lower(start) {
+				log.Panic(rs.T("The end of a rental cannot be before its start"))
+			}
+			hours := end.Sub(start).Hours()
+			_, price := h.ProductRentalRate().NewSet(rs.Env()).ComputeRentalPeriods(rs, hours)
+			if pricelist.IsEmpty() {
+				return price
+			}
+			price = rs.Currency().Compute(price, pricelist.Currency(), false)
+			return pricelist.ApplyRentalRule(rs, price, hours/24, start.ToDate())
+		})
+
+	h.ProductTemplate().AddFields(map[string]models.FieldDefinition{
+		"RentalRates": models.One2ManyField{String: "Rental Rates", RelationModel: h.ProductRentalRate(),
+			ReverseFK: "ProductTmpl", JSON: "rental_rate_ids"},
+	})
+
+	h.ProductPricelistItem().AddFields(map[string]models.FieldDefinition{
+		"RentalOnly": models.BooleanField{String: "Rentals Only",
+			Help: `If set, this rule only applies to rentals and is applied on the rental price computed
+from the rental rates of the product. The minimum quantity is then the minimum rental duration in days
+and fixed prices are prices per rental day.`},
+	})
+
+	h.ProductPricelist().Methods().ApplyRentalRule().DeclareMethod(
+		`ApplyRentalRule applies the first rental rule of this pricelist matching the given product,
+		rental duration in days and date to the given rental price and returns the result.`,
+		func(rs m.ProductPricelistSet, product m.ProductProductSet, price float64, days float64, date dates.Date) float64 {
+			rs.EnsureOne()
+			categs := h.ProductCategory().NewSet(rs.Env())
+			for categ := product.Category(); !categ.IsEmpty(); categ = categ.Parent() {
+				categs = categs.Union(categ)
+			}
+			items := h.ProductPricelistItem().Search(rs.Env(),
+				q.ProductPricelistItem().Pricelist().Equals(rs).
+					And().RentalOnly().Equals(true).
+					AndCond(q.ProductPricelistItem().ProductTmpl().IsNull().Or().ProductTmpl().Equals(product.ProductTmpl())).
+					AndCond(q.ProductPricelistItem().Product().IsNull().Or().Product().Equals(product)).
+					AndCond(q.ProductPricelistItem().Category().IsNull().Or().Category().In(categs)).
+					AndCond(q.ProductPricelistItem().DateStart().IsNull().Or().DateStart().LowerOrEqual(date)).
+					AndCond(q.ProductPricelistItem().DateEnd().IsNull().Or().DateEnd().GreaterOrEqual(date))).
+				OrderBy("AppliedOn", "MinQuantity DESC", "Category.Name")
+			for _, rule := range items.Records() {
+				if rule.MinQuantity() != 0 && days < rule.MinQuantity() {
+					continue
+				}
+				switch rule.ComputePrice() {
+				case "fixed":
+					return rule.FixedPrice() * math.Ceil(days-rentalTolerance)
+				case "percentage":
+					return price - (price * (rule.PercentPrice() / 100))
+				case "formula":
+					priceLimit := price
+					price = price - (price * (rule.PriceDiscount() / 100))
+					if rule.PriceRound() != 0 {
+						price = nbutils.Round(price, rule.PriceRound())
+					}
+					price += rule.PriceSurcharge()
+					if rule.PriceMinMargin() != 0 {
+						price = math.Max(price, priceLimit+rule.PriceMinMargin())
+					}
+					if rule.PriceMaxMargin() != 0 {
+						price = math.Min(price, priceLimit+rule.PriceMaxMargin())
+					}
+					return price
+				}
+			}
+			return price
+		})
+
+}
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
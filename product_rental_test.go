@@ -0,0 +1,120 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRental(t *testing.T) {
+	Convey("Testing rental prices", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			uomHour := h.ProductUom().NewSet(env).GetRecord("product_product_uom_hour")
+			uomDay := h.ProductUom().NewSet(env).GetRecord("product_product_uom_day")
+			uomWeek := h.ProductUom().NewSet(env).GetRecord("product_product_uom_week")
+			product := ptd.product1
+			product.ProductTmpl().SetRental(true)
+			h.ProductRentalRate().Create(env, h.ProductRentalRate().NewData().
+				SetProductTmpl(product.ProductTmpl()).
+				SetUom(uomHour).
+				SetPrice(10).
+				SetMinDuration(4))
+			h.ProductRentalRate().Create(env, h.ProductRentalRate().NewData().
+				SetProductTmpl(product.ProductTmpl()).
+				SetUom(uomDay).
+				SetPrice(50))
+			h.ProductRentalRate().Create(env, h.ProductRentalRate().NewData().
+				SetProductTmpl(product.ProductTmpl()).
+				SetUom(uomWeek).
+				SetPrice(200))
+			start := dates.ParseDateTime("2018-03-05 08:00:00")
+			noPricelist := h.ProductPricelist().NewSet(env)
+			rates := h.ProductRentalRate().NewSet(env)
+			Convey("Time units should be converted to calendar hours", func() {
+				So(uomHour.CalendarHours(), ShouldAlmostEqual, 1, 0.0001)
+				So(uomDay.CalendarHours(), ShouldAlmostEqual, 24, 0.0001)
+				So(uomWeek.CalendarHours(), ShouldAlmostEqual, 168, 0.0001)
+				So(func() { ptd.uomUnit.CalendarHours() }, ShouldPanic)
+			})
+			Convey("The cheapest combination of periods should be chosen", func() {
+				So(product.ComputeRentalPrice(start, start.Add(2*time.Hour), noPricelist), ShouldAlmostEqual, 40, 0.01)
+				So(product.ComputeRentalPrice(start, start.Add(6*time.Hour), noPricelist), ShouldAlmostEqual, 50, 0.01)
+				So(product.ComputeRentalPrice(start, start.Add(30*time.Hour), noPricelist), ShouldAlmostEqual, 100, 0.01)
+				So(product.ComputeRentalPrice(start, start.AddDate(0, 0, 6), noPricelist), ShouldAlmostEqual, 200, 0.01)
+				periods, price := rates.ComputeRentalPeriods(product, 8*24+3)
+				So(price, ShouldAlmostEqual, 290, 0.01)
+				So(periods, ShouldHaveLength, 3)
+				So(periods[0].Periods, ShouldEqual, 1)
+				So(periods[1].Periods, ShouldEqual, 1)
+				So(periods[2].Periods, ShouldEqual, 4)
+				periods, price = rates.ComputeRentalPeriods(product, 180*24+5)
+				So(price, ShouldAlmostEqual, 5200, 0.01)
+				So(periods, ShouldHaveLength, 1)
+				So(periods[0].Periods, ShouldEqual, 26)
+			})
+			Convey("Variant rates should replace template rates with the same period", func() {
+				h.ProductRentalRate().Create(env, h.ProductRentalRate().NewData().
+					SetProduct(product).
+					SetUom(uomDay).
+					SetPrice(20))
+				So(rates.ApplicableRates(product).Len(), ShouldEqual, 3)
+				So(product.ComputeRentalPrice(start, start.AddDate(0, 0, 6), noPricelist), ShouldAlmostEqual, 120, 0.01)
+			})
+			Convey("Only rentable products can be rented", func() {
+				product.ProductTmpl().SetRental(false)
+				So(func() { product.ComputeRentalPrice(start, start.AddDate(0, 0, 1), noPricelist) }, ShouldPanic)
+			})
+			Convey("Rental pricelist rules should only apply to rentals", func() {
+				pricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("Rental pricelist").
+					SetCurrency(product.Currency()))
+				h.ProductPricelistItem().Create(env, h.ProductPricelistItem().NewData().
+					SetPricelist(pricelist).
+					SetRentalOnly(true).
+					SetComputePrice("percentage").
+					SetPercentPrice(10).
+					SetMinQuantity(0).
+					SetAppliedOn("3_global"))
+				h.ProductPricelistItem().Create(env, h.ProductPricelistItem().NewData().
+					SetPricelist(pricelist).
+					SetRentalOnly(true).
+					SetComputePrice("fixed").
+					SetFixedPrice(15).
+					SetMinQuantity(7).
+					SetAppliedOn("3_global"))
+				So(product.ComputeRentalPrice(start, start.AddDate(0, 0, 6), pricelist), ShouldAlmostEqual, 180, 0.01)
+				So(product.ComputeRentalPrice(start, start.AddDate(0, 0, 10), pricelist), ShouldAlmostEqual, 150, 0.01)
+				So(pricelist.GetProductPrice(product, 1, h.Partner().NewSet(env), dates.Date{}, h.ProductUom().NewSet(env)),
+					ShouldAlmostEqual, product.ListPrice(), 0.01)
+			})
+			Convey("Rental formula rules should respect the pricelist margins", func() {
+				pricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("Rental margins").
+					SetCurrency(product.Currency()))
+				rule := h.ProductPricelistItem().Create(env, h.ProductPricelistItem().NewData().
+					SetPricelist(pricelist).
+					SetRentalOnly(true).
+					SetComputePrice("formula").
+					SetPriceDiscount(50).
+					SetPriceMinMargin(-20).
+					SetAppliedOn("3_global"))
+				So(product.ComputeRentalPrice(start, start.AddDate(0, 0, 6), pricelist), ShouldAlmostEqual, 180, 0.01)
+				rule.Write(h.ProductPricelistItem().NewData().
+					SetPriceDiscount(0).
+					SetPriceSurcharge(50).
+					SetPriceMinMargin(0).
+					SetPriceMaxMargin(30))
+				So(product.ComputeRentalPrice(start, start.AddDate(0, 0, 6), pricelist), ShouldAlmostEqual, 230, 0.01)
+			})
+		}), ShouldBeNil)
+	})
+}
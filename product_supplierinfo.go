@@ -0,0 +1,212 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+
+	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.ProductSupplierinfo().DeclareModel()
+	h.ProductSupplierinfo().SetDefaultOrder("Sequence", "MinQty DESC", "Price")
+
+	h.ProductSupplierinfo().AddFields(map[string]models.FieldDefinition{
+		"Name": models.Many2OneField{String: "Vendor", RelationModel: h.Partner(), JSON: "name",
+			Filter: q.Partner().Supplier().Equals(true), OnDelete: models.Cascade, Required: true,
+			Help: "Vendor of this product"},
+		"ProductName": models.CharField{String: "Vendor Product Name",
+			Help: `This vendor's product name will be used when printing a request for quotation.
+Keep empty to use the internal one.`},
+		"ProductCode": models.CharField{String: "Vendor Product Code",
+			Help: `This vendor's product code will be used when printing a request for quotation.
+Keep empty to use the internal one.`},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(1),
+			Help: "Assigns the priority to the list of product vendor."},
+		// ProductUom used to be related to ProductTmpl.UomPo. An empty value still means the
+		// purchase unit of measure of the product, so it must always be read through PurchaseUom.
+		"ProductUom": models.Many2OneField{String: "Vendor Unit of Measure", RelationModel: h.ProductUom(),
+			Constraint: h.ProductSupplierinfo().Methods().CheckUom(),
+			Help: `Unit of measure in which this vendor sells the product. The minimal quantity and the price
+are expressed in this unit. Keep empty to use the purchase unit of measure of the product.`},
+		"MinQty": models.FloatField{String: "Minimal Quantity", Default: models.DefaultValue(0), Required: true,
+			Help: `The minimal quantity to purchase from this vendor, expressed in the vendor unit of measure if any,
+or in the purchase unit of measure of the product otherwise.`},
+		"Price": models.FloatField{Default: models.DefaultValue(0), Digits: decimalPrecision.GetPrecision("Product Price"),
+			Required: true, Help: "The price to purchase a product"},
+		"Company": models.Many2OneField{RelationModel: h.Company(), Default: func(env models.Environment) interface{} {
+			return h.User().NewSet(env).CurrentUser().Company()
+		}, Index: true},
+		"Currency": models.Many2OneField{RelationModel: h.Currency(), Default: func(env models.Environment) interface{} {
+			return h.User().NewSet(env).CurrentUser().Company().Currency()
+		}, Required: true},
+		"DateStart": models.DateField{String: "Start Date", Help: "Start date for this vendor price"},
+		"DateEnd":   models.DateField{String: "End Date", Help: "End date for this vendor price"},
+		"Product": models.Many2OneField{String: "Product Variant", RelationModel: h.ProductProduct(),
+			Constraint: h.ProductSupplierinfo().Methods().CheckUom(),
+			Help:       "When this field is filled in, the vendor data will only apply to the variant."},
+		"ProductTmpl": models.Many2OneField{String: "Product Template", RelationModel: h.ProductTemplate(),
+			Index: true, OnDelete: models.Cascade, Constraint: h.ProductSupplierinfo().Methods().CheckUom()},
+		"Active": models.BooleanField{Default: models.DefaultValue(true), Required: true,
+			Help: "If unchecked, it will allow you to hide the vendor price without removing it."},
+		"Delay": models.IntegerField{String: "Delivery Lead Time", Default: models.DefaultValue(1), Required: true,
+			Help: `Lead time in days between the confirmation of the purchase order and the receipt of the
+products in your warehouse. Used by the scheduler for automatic computation of the purchase order planning.`},
+	})
+
+	h.ProductSupplierinfo().Methods().ProductUnitUom().DeclareMethod(
+		`ProductUnitUom returns the default unit of measure of the product of this vendor line.`,
+		func(rs m.ProductSupplierinfoSet) m.ProductUomSet {
+			rs.EnsureOne()
+			if !rs.Product().IsEmpty() {
+				return rs.Product().Uom()
+			}
+			return rs.ProductTmpl().Uom()
+		})
+
+	h.ProductSupplierinfo().Methods().PurchaseUom().DeclareMethod(
+		`PurchaseUom returns the unit of measure in which the minimal quantity and the price of this
+		vendor line are expressed, that is the vendor unit of measure if set, or the purchase unit of
+		measure of the product otherwise. Vendor lines created before the vendor unit of measure
+		existed have no ProductUom and are thus read in the purchase unit of measure as before.`,
+		func(rs m.ProductSupplierinfoSet) m.ProductUomSet {
+			rs.EnsureOne()
+			switch {
+			case !rs.ProductUom().IsEmpty():
+				return rs.ProductUom()
+			case !rs.Product().IsEmpty():
+				return rs.Product().UomPo()
+			}
+			return rs.ProductTmpl().UomPo()
+		})
+
+	h.ProductSupplierinfo().Methods().CheckUom().DeclareMethod(
+		`CheckUom checks that the vendor unit of measure is in the same category
+		as the unit of measure of the product.`,
+		func(rs m.ProductSupplierinfoSet) {
+			for _, seller := range rs.Records() {
+				productUom := seller.ProductUnitUom()
+				if seller.ProductUom().IsEmpty() || productUom.IsEmpty() {
+					continue
+				}
+				if !seller.ProductUom().Category().Equals(productUom.Category()) {
+					log.Panic(rs.T("Error: The vendor unit of measure must be in the same category as the unit of measure of the product."))
+				}
+			}
+		})
+
+	h.ProductSupplierinfo().Methods().MinQtyIn().DeclareMethod(
+		`MinQtyIn returns the minimal quantity of this vendor line expressed in the given unit of measure.
+		If uom is empty, the minimal quantity is returned in the unit of measure of the product.`,
+		func(rs m.ProductSupplierinfoSet, uom m.ProductUomSet) float64 {
+			rs.EnsureOne()
+			if uom.IsEmpty() {
+				uom = rs.ProductUnitUom()
+			}
+			purchaseUom := rs.PurchaseUom()
+			if purchaseUom.IsEmpty() || uom.IsEmpty() || purchaseUom.Equals(uom) {
+				return rs.MinQty()
+			}
+			return purchaseUom.ComputeQuantity(rs.MinQty(), uom, false)
+		})
+
+	h.ProductSupplierinfo().Methods().PriceIn().DeclareMethod(
+		`PriceIn returns the price of this vendor line for one unit of the given unit of measure,
+		in the currency of the line. If uom is empty, the price is returned for one unit of
+		measure of the product.`,
+		func(rs m.ProductSupplierinfoSet, uom m.ProductUomSet) float64 {
+			rs.EnsureOne()
+			if uom.IsEmpty() {
+				uom = rs.ProductUnitUom()
+			}
+			purchaseUom := rs.PurchaseUom()
+			if purchaseUom.IsEmpty() || uom.IsEmpty() || purchaseUom.Equals(uom) {
+				return rs.Price()
+			}
+			return purchaseUom.ComputePrice(rs.Price(), uom)
+		})
+
+	h.ProductSupplierinfo().Methods().ComparablePrice().DeclareMethod(
+		`ComparablePrice returns the unit price of this vendor line for the given product,
+		expressed in the product's default UoM and in the currency of the line's company
+		(or of the current user's company if the line has no company).`,
+		func(rs m.ProductSupplierinfoSet, product m.ProductProductSet) float64 {
+			rs.EnsureOne()
+			price := rs.PriceIn(product.Uom())
+			company := rs.Company()
+			if company.IsEmpty() {
+				company = h.User().NewSet(rs.Env()).CurrentUser().Company()
+			}
+			return rs.Currency().Compute(price, company.Currency(), false)
+		})
+
+	h.ProductSupplierinfo().Methods().ExpiringByVendor().DeclareMethod(
+		`ExpiringByVendor returns the active vendor lines that end within the given number of days,
+		grouped by vendor ID. Lines that have already ended are not returned.
+
+		This method is meant to be called periodically to warn buyers of the prices to renegotiate.`,
+		func(rs m.ProductSupplierinfoSet, days int) map[int64]m.ProductSupplierinfoSet {
+			today := dates.Today()
+			sellers := h.ProductSupplierinfo().Search(rs.Env(),
+				q.ProductSupplierinfo().DateEnd().GreaterOrEqual(today).
+					And().DateEnd().LowerOrEqual(today.AddDate(0, 0, days))).
+				OrderBy("DateEnd", "ID")
+			res := make(map[int64]m.ProductSupplierinfoSet)
+			for _, seller := range sellers.Records() {
+				vendorID := seller.Name().ID()
+				if _, exists := res[vendorID]; !exists {
+					res[vendorID] = h.ProductSupplierinfo().NewSet(rs.Env())
+				}
+				res[vendorID] = res[vendorID].Union(seller)
+			}
+			return res
+		})
+
+	h.ProductSupplierinfo().Methods().CleanSuperseded().DeclareMethod(
+		`CleanSuperseded archives the ended vendor lines that have been superseded by a newer line
+		of the same vendor and product that is still valid. If unlink is true, the superseded lines
+		are deleted instead. It returns the archived lines, or an empty set if they were deleted.
+
+		A line is newer if it starts after the end of the ended line or, if it has no start date,
+		if it has been created after it. Ended lines that have not been superseded are kept since
+		they may be the only known price of this vendor.
+
+		This method is meant to be called periodically.`,
+		func(rs m.ProductSupplierinfoSet, unlink bool) m.ProductSupplierinfoSet {
+			today := dates.Today()
+			expired := h.ProductSupplierinfo().Search(rs.Env(), q.ProductSupplierinfo().DateEnd().Lower(today))
+			superseded := h.ProductSupplierinfo().NewSet(rs.Env())
+			for _, seller := range expired.Records() {
+				cond := q.ProductSupplierinfo().Name().Equals(seller.Name()).
+					And().ProductTmpl().Equals(seller.ProductTmpl()).
+					And().ID().NotEquals(seller.ID()).
+					AndCond(q.ProductSupplierinfo().DateEnd().IsNull().Or().DateEnd().GreaterOrEqual(today)).
+					AndCond(q.ProductSupplierinfo().DateStart().Greater(seller.DateEnd()).
+						OrCond(q.ProductSupplierinfo().DateStart().IsNull().And().ID().Greater(seller.ID())))
+				if seller.Product().IsEmpty() {
+					cond = cond.And().Product().IsNull()
+				} else {
+					cond = cond.And().Product().Equals(seller.Product())
+				}
+				if h.ProductSupplierinfo().Search(rs.Env(), cond).SearchCount() == 0 {
+					continue
+				}
+				superseded = superseded.Union(seller)
+			}
+			if unlink {
+				superseded.Unlink()
+				return h.ProductSupplierinfo().NewSet(rs.Env())
+			}
+			superseded.SetActive(false)
+			return superseded
+		})
+
+}
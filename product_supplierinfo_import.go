@@ -0,0 +1,367 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/nbutils"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// catalogueColumns lists the columns that can appear in a vendor catalogue.
+// Column names are matched case-insensitively against the header line.
+var catalogueColumns = []string{
+	"default_code", "barcode", "product_code", "product_name", "min_qty",
+	"price", "currency", "uom", "date_start", "date_end", "delay",
+}
+
+func init() {
+
+	h.ProductSupplierinfo().Methods().MatchCatalogueProduct().DeclareMethod(
+		`MatchCatalogueProduct returns the product template and variant referenced by a line of
+		the catalogue of the given vendor. Products are matched in turn by internal reference,
+		by barcode and by the vendor's product code of an existing vendor line.
+
+		The returned variant is empty when the line applies to all the variants of the template.`,
+		func(rs m.ProductSupplierinfoSet, vendor m.PartnerSet, defaultCode, barcode, productCode string) (m.ProductTemplateSet, m.ProductProductSet) {
+			product := h.ProductProduct().NewSet(rs.Env())
+			if defaultCode != "" {
+				product = h.ProductProduct().Search(rs.Env(), q.ProductProduct().DefaultCode().Equals(defaultCode))
+			}
+			if product.Len() != 1 && barcode != "" {
+				product = h.ProductProduct().Search(rs.Env(), q.ProductProduct().Barcode().Equals(barcode))
+			}
+			if product.Len() == 1 {
+				if product.ProductTmpl().ProductVariants().Len() == 1 {
+					return product.ProductTmpl(), h.ProductProduct().NewSet(rs.Env())
+				}
+				return product.ProductTmpl(), product
+			}
+			if productCode != "" {
+				sellers := h.ProductSupplierinfo().Search(rs.Env(),
+					q.ProductSupplierinfo().Name().Equals(vendor).
+						And().ProductCode().Equals(productCode))
+				if !sellers.IsEmpty() {
+					seller := sellers.Records()[0]
+					return seller.ProductTmpl(), seller.Product()
+				}
+			}
+			return h.ProductTemplate().NewSet(rs.Env()), h.ProductProduct().NewSet(rs.Env())
+		})
+
+	h.ProductSupplierinfo().Methods().ImportCatalogue().DeclareMethod(
+		`ImportCatalogue imports the given CSV catalogue of vendor prices and returns the data of
+		one report line per catalogue line.
+
+		The first line of the catalogue must be a header with the following columns (in any order):
+		default_code, barcode, product_code, product_name, min_qty, price, currency, uom,
+		date_start, date_end and delay. Only price and one of default_code, barcode or product_code
+		are mandatory. Currencies are given by their ISO code and units of measure by their
+		UN/ECE code. Lines without start date start at dateStart, or today if dateStart is zero.
+
+		A catalogue line updates the vendor line of the same product, minimal quantity and currency
+		that is valid at its start date. If this vendor line started earlier, it is not overwritten
+		but ended the day before and a new vendor line is created instead.
+
+		If dryRun is true, the report is computed but the database is not modified.`,
+		func(rs m.ProductSupplierinfoSet, vendor m.PartnerSet, content []byte, dateStart dates.Date, dryRun bool) []m.ProductSupplierinfoImportLineData {
+			vendor.EnsureOne()
+			if dateStart.IsZero() {
+				dateStart = dates.Today()
+			}
+			reader := csv.NewReader(bytes.NewReader(content))
+			reader.TrimLeadingSpace = true
+			// Lines with a wrong number of columns are reported as errors below
+			reader.FieldsPerRecord = -1
+			header, err := reader.Read()
+			if err != nil {
+				log.Panic(rs.T("Unable to read the catalogue header: %s", err))
+			}
+			columns := make(map[string]int)
+			for i, col := range header {
+				columns[strings.ToLower(strings.TrimSpace(col))] = i
+			}
+			if _, ok := columns["price"]; !ok {
+				log.Panic(rs.T("The catalogue has no 'price' column"))
+			}
+			defaultCurrency := h.User().NewSet(rs.Env()).CurrentUser().Company().Currency()
+			var res []m.ProductSupplierinfoImportLineData
+			for lineNumber := 2; ; lineNumber++ {
+				record, err := reader.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					res = append(res, h.ProductSupplierinfoImportLine().NewData().
+						SetLineNumber(int64(lineNumber)).
+						SetStatus("error").
+						SetDescription(rs.T("Unable to read this line: %s", err)))
+					continue
+				}
+				values := make(map[string]string)
+				for _, col := range catalogueColumns {
+					if i, ok := columns[col]; ok && i < len(record) {
+						values[col] = strings.TrimSpace(record[i])
+					}
+				}
+				reference := values["default_code"]
+				for _, col := range []string{"barcode", "product_code"} {
+					if reference == "" {
+						reference = values[col]
+					}
+				}
+				line := h.ProductSupplierinfoImportLine().NewData().
+					SetLineNumber(int64(lineNumber)).
+					SetReference(reference)
+				res = append(res, line)
+				markError := func(format string, args ...interface{}) {
+					line.SetStatus("error").SetDescription(rs.T(format, args...))
+				}
+				if len(record) != len(header) {
+					markError("This line has %d columns instead of %d", len(record), len(header))
+					continue
+				}
+				price, err := strconv.ParseFloat(values["price"], 64)
+				if err != nil {
+					markError("Invalid price: %s", values["price"])
+					continue
+				}
+				line.SetPrice(price)
+				var minQty float64
+				if values["min_qty"] != "" {
+					minQty, err = strconv.ParseFloat(values["min_qty"], 64)
+					if err != nil {
+						markError("Invalid minimal quantity: %s", values["min_qty"])
+						continue
+					}
+				}
+				line.SetMinQty(minQty)
+				lineStart, lineEnd := dateStart, dates.Date{}
+				if values["date_start"] != "" {
+					lineStart, err = dates.ParseDateWithLayout(dates.DefaultServerDateFormat, values["date_start"])
+					if err != nil {
+						markError("Invalid start date: %s", values["date_start"])
+						continue
+					}
+				}
+				if values["date_end"] != "" {
+					lineEnd, err = dates.ParseDateWithLayout(dates.DefaultServerDateFormat, values["date_end"])
+					if err != nil || lineEnd.Lower(lineStart) {
+						markError("Invalid end date: %s", values["date_end"])
+						continue
+					}
+				}
+				line.SetDateStart(lineStart).SetDateEnd(lineEnd)
+				var delay int64
+				if values["delay"] != "" {
+					delay, err = strconv.ParseInt(values["delay"], 10, 64)
+					if err != nil || delay < 0 {
+						markError("Invalid delivery lead time: %s", values["delay"])
+						continue
+					}
+				}
+				currency := defaultCurrency
+				if values["currency"] != "" {
+					currency = h.Currency().Search(rs.Env(), q.Currency().Name().Equals(strings.ToUpper(values["currency"])))
+					if currency.Len() != 1 {
+						markError("Unknown currency: %s", values["currency"])
+						continue
+					}
+				}
+				line.SetCurrency(currency)
+				tmpl, product := rs.MatchCatalogueProduct(vendor, values["default_code"], values["barcode"], values["product_code"])
+				if tmpl.IsEmpty() {
+					line.SetStatus("unmatched").SetDescription(rs.T("No product matches this line"))
+					continue
+				}
+				line.SetProductTmpl(tmpl).SetProduct(product)
+				uom := h.ProductUom().NewSet(rs.Env())
+				if values["uom"] != "" {
+					uom = h.ProductUom().NewSet(rs.Env()).GetByUneceCode(values["uom"], tmpl.Uom().Category())
+					if uom.IsEmpty() {
+						markError("Unknown unit of measure for this product: %s", values["uom"])
+						continue
+					}
+				}
+				existing := h.ProductSupplierinfo().NewSet(rs.Env())
+				cond := q.ProductSupplierinfo().Name().Equals(vendor).
+					And().ProductTmpl().Equals(tmpl).
+					And().Currency().Equals(currency).
+					AndCond(q.ProductSupplierinfo().DateStart().IsNull().Or().DateStart().LowerOrEqual(lineStart)).
+					AndCond(q.ProductSupplierinfo().DateEnd().IsNull().Or().DateEnd().GreaterOrEqual(lineStart))
+				if product.IsEmpty() {
+					cond = cond.And().Product().IsNull()
+				} else {
+					cond = cond.And().Product().Equals(product)
+				}
+				candidates := h.ProductSupplierinfo().Search(rs.Env(), cond)
+				for _, candidate := range candidates.Records() {
+					// The minimal quantity of the catalogue is expressed in its unit of measure if
+					// any, or in the purchase unit of measure of the vendor line otherwise.
+					catalogueUom := uom
+					if catalogueUom.IsEmpty() {
+						catalogueUom = candidate.PurchaseUom()
+					}
+					if nbutils.Compare(candidate.MinQtyIn(catalogueUom), minQty, catalogueUom.Rounding()) != 0 {
+						continue
+					}
+					if existing.IsEmpty() || candidate.DateStart().Greater(existing.DateStart()) {
+						existing = candidate
+					}
+				}
+				newData := h.ProductSupplierinfo().NewData().
+					SetName(vendor).
+					SetProductTmpl(tmpl).
+					SetProduct(product).
+					SetMinQty(minQty).
+					SetPrice(price).
+					SetCurrency(currency).
+					SetDateStart(lineStart).
+					SetDateEnd(lineEnd)
+				if values["product_code"] != "" {
+					newData.SetProductCode(values["product_code"])
+				}
+				if values["product_name"] != "" {
+					newData.SetProductName(values["product_name"])
+				}
+				if values["delay"] != "" {
+					newData.SetDelay(delay)
+				}
+				if !uom.IsEmpty() {
+					newData.SetProductUom(uom)
+				}
+				if existing.IsEmpty() {
+					line.SetStatus("new")
+					if !dryRun {
+						line.SetSupplierinfo(h.ProductSupplierinfo().Create(rs.Env(), newData))
+					}
+					continue
+				}
+				line.SetSupplierinfo(existing).SetOldPrice(existing.Price())
+				var changes []string
+				if existing.Price() != price {
+					changes = append(changes, rs.T("price"))
+				}
+				if !existing.DateEnd().Equal(lineEnd) {
+					changes = append(changes, rs.T("end date"))
+				}
+				if newData.HasDelay() && existing.Delay() != delay {
+					changes = append(changes, rs.T("delivery lead time"))
+				}
+				if newData.HasProductCode() && existing.ProductCode() != newData.ProductCode() {
+					changes = append(changes, rs.T("vendor product code"))
+				}
+				if newData.HasProductName() && existing.ProductName() != newData.ProductName() {
+					changes = append(changes, rs.T("vendor product name"))
+				}
+				if !uom.IsEmpty() && !existing.PurchaseUom().Equals(uom) {
+					changes = append(changes, rs.T("unit of measure"))
+				}
+				if len(changes) == 0 {
+					line.SetStatus("unchanged")
+					continue
+				}
+				line.SetStatus("changed").SetDescription(rs.T("Changed: %s", strings.Join(changes, ", ")))
+				if dryRun {
+					continue
+				}
+				if existing.DateStart().Equal(lineStart) {
+					existing.Write(newData.UnsetDateStart())
+					continue
+				}
+				existing.SetDateEnd(lineStart.AddDate(0, 0, -1))
+				newData.SetSequence(existing.Sequence())
+				if uom.IsEmpty() {
+					newData.SetProductUom(existing.ProductUom())
+				}
+				line.SetSupplierinfo(h.ProductSupplierinfo().Create(rs.Env(), newData))
+			}
+			return res
+		})
+
+	h.ProductSupplierinfoImport().DeclareTransientModel()
+
+	h.ProductSupplierinfoImport().AddFields(map[string]models.FieldDefinition{
+		"Vendor": models.Many2OneField{RelationModel: h.Partner(), Required: true,
+			Filter: q.Partner().Supplier().Equals(true)},
+		"File": models.BinaryField{String: "Catalogue", Required: true,
+			Help: "CSV file with a header line. See the documentation of ImportCatalogue for the available columns."},
+		"FileName": models.CharField{},
+		"DateStart": models.DateField{String: "Start Date", Required: true,
+			Default: func(env models.Environment) interface{} {
+				return dates.Today()
+			}, Help: "Start date of the catalogue lines that do not have their own start date."},
+		"DryRun": models.BooleanField{String: "Dry Run", Default: models.DefaultValue(true),
+			Help: "If set, only the report is computed and the vendor pricelists are left untouched."},
+		"Lines": models.One2ManyField{String: "Report", RelationModel: h.ProductSupplierinfoImportLine(),
+			ReverseFK: "Import", JSON: "line_ids", ReadOnly: true},
+	})
+
+	h.ProductSupplierinfoImport().Methods().Run().DeclareMethod(
+		`Run imports the catalogue of this wizard, fills in the report lines
+		and returns an action to display them.`,
+		func(rs m.ProductSupplierinfoImportSet) *actions.Action {
+			rs.EnsureOne()
+			content, err := base64.StdEncoding.DecodeString(rs.File())
+			if err != nil {
+				log.Panic(rs.T("Unable to decode the catalogue file: %s", err))
+			}
+			rs.Lines().Unlink()
+			lines := h.ProductSupplierinfo().NewSet(rs.Env()).ImportCatalogue(rs.Vendor(), content, rs.DateStart(), rs.DryRun())
+			for _, line := range lines {
+				h.ProductSupplierinfoImportLine().Create(rs.Env(), line.SetImport(rs))
+			}
+			return &actions.Action{
+				Type:     actions.ActionActWindow,
+				Model:    "ProductSupplierinfoImport",
+				ViewMode: "form",
+				ResID:    rs.ID(),
+				Target:   "new",
+			}
+		})
+
+	h.ProductSupplierinfoImportLine().DeclareTransientModel()
+	h.ProductSupplierinfoImportLine().SetDefaultOrder("LineNumber")
+
+	h.ProductSupplierinfoImportLine().AddFields(map[string]models.FieldDefinition{
+		"Import":     models.Many2OneField{RelationModel: h.ProductSupplierinfoImport(), OnDelete: models.Cascade},
+		"LineNumber": models.IntegerField{String: "Line"},
+		"Reference":  models.CharField{},
+		"Status": models.SelectionField{Selection: types.Selection{
+			"new":       "New",
+			"changed":   "Changed",
+			"unchanged": "Unchanged",
+			"unmatched": "Unmatched",
+			"error":     "Error",
+		}, Required: true},
+		"ProductTmpl": models.Many2OneField{String: "Product Template", RelationModel: h.ProductTemplate(),
+			JSON: "product_tmpl_id"},
+		"Product": models.Many2OneField{String: "Product Variant", RelationModel: h.ProductProduct()},
+		"Supplierinfo": models.Many2OneField{String: "Vendor Line", RelationModel: h.ProductSupplierinfo(),
+			Help: "The vendor line that has been updated or created by this catalogue line."},
+		"MinQty": models.FloatField{String: "Minimal Quantity"},
+		"OldPrice": models.FloatField{String: "Previous Price",
+			Digits: decimalPrecision.GetPrecision("Product Price")},
+		"Price":       models.FloatField{Digits: decimalPrecision.GetPrecision("Product Price")},
+		"Currency":    models.Many2OneField{RelationModel: h.Currency()},
+		"DateStart":   models.DateField{String: "Start Date"},
+		"DateEnd":     models.DateField{String: "End Date"},
+		"Description": models.CharField{},
+	})
+
+}
@@ -0,0 +1,188 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+	"math"
+	"sort"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+func init() {
+
+	h.ProductSupplierinfoLeadTime().DeclareModel()
+	h.ProductSupplierinfoLeadTime().SetDefaultOrder("ReceiptDate DESC", "ID DESC")
+
+	h.ProductSupplierinfoLeadTime().AddFields(map[string]models.FieldDefinition{
+		"Supplierinfo": models.Many2OneField{String: "Vendor Line", RelationModel: h.ProductSupplierinfo(),
+			Required: true, OnDelete: models.Cascade, Index: true},
+		"Vendor": models.Many2OneField{RelationModel: h.Partner(), Related: "Supplierinfo.Name", ReadOnly: true},
+		"OrderDate": models.DateField{String: "Order Date", Required: true,
+			Constraint: h.ProductSupplierinfoLeadTime().Methods().CheckDates(),
+			Help:       "Date at which the purchase order has been confirmed."},
+		"ReceiptDate": models.DateField{String: "Receipt Date", Required: true,
+			Constraint: h.ProductSupplierinfoLeadTime().Methods().CheckDates(),
+			Help:       "Date at which the products have been received."},
+		"Duration": models.IntegerField{String: "Lead Time", Compute: h.ProductSupplierinfoLeadTime().Methods().ComputeDuration(),
+			Stored: true, Depends: []string{"OrderDate", "ReceiptDate"},
+			Help: "Observed number of days between the order and the receipt."},
+		"PromisedDelay": models.IntegerField{String: "Promised Lead Time",
+			Help: "Delivery lead time in days of the vendor line when the order was confirmed."},
+		"OnTime": models.BooleanField{String: "On Time", Compute: h.ProductSupplierinfoLeadTime().Methods().ComputeOnTime(),
+			Stored: true, Depends: []string{"Duration", "PromisedDelay"}},
+		"Reference": models.CharField{Help: "Reference of the order or receipt this observation comes from."},
+	})
+
+	h.ProductSupplierinfoLeadTime().Methods().CheckDates().DeclareMethod(
+		`CheckDates panics if the receipt date of this observation is before its order date.`,
+		func(rs m.ProductSupplierinfoLeadTimeSet) {
+			for _, observation := range rs.Records() {
+				if observation.ReceiptDate().Lower(observation.OrderDate()) {
+					log.Panic(rs.T("The receipt date cannot be before the order date"))
+				}
+			}
+		})
+
+	h.ProductSupplierinfoLeadTime().Methods().ComputeDuration().DeclareMethod(
+		`ComputeDuration computes the number of days between the order and the receipt.`,
+		func(rs m.ProductSupplierinfoLeadTimeSet) m.ProductSupplierinfoLeadTimeData {
+			return h.ProductSupplierinfoLeadTime().NewData().
+				SetDuration(int64(math.Round(rs.ReceiptDate().Sub(rs.OrderDate()).Hours() / 24)))
+		})
+
+	h.ProductSupplierinfoLeadTime().Methods().ComputeOnTime().DeclareMethod(
+		`ComputeOnTime sets OnTime if the products were received within the promised lead time.`,
+		func(rs m.ProductSupplierinfoLeadTimeSet) m.ProductSupplierinfoLeadTimeData {
+			return h.ProductSupplierinfoLeadTime().NewData().SetOnTime(rs.Duration() <= rs.PromisedDelay())
+		})
+
+	h.ProductSupplierinfoLeadTime().Methods().Create().Extend("",
+		func(rs m.ProductSupplierinfoLeadTimeSet, data m.ProductSupplierinfoLeadTimeData) m.ProductSupplierinfoLeadTimeSet {
+			if !data.HasPromisedDelay() {
+				data.SetPromisedDelay(data.Supplierinfo().Delay())
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.ProductSupplierinfo().AddFields(map[string]models.FieldDefinition{
+		"LeadTimes": models.One2ManyField{String: "Observed Lead Times", RelationModel: h.ProductSupplierinfoLeadTime(),
+			ReverseFK: "Supplierinfo", JSON: "lead_time_ids"},
+		"AutoDelay": models.BooleanField{String: "Update Lead Time Automatically",
+			Help: `If set, the delivery lead time is updated each time a lead time is observed, with the
+90th percentile of the observed lead times rounded up to the next day.`},
+		"LeadTimeCount": models.IntegerField{String: "Observations",
+			Compute: h.ProductSupplierinfo().Methods().ComputeLeadTimeStats()},
+		"LeadTimeMean": models.FloatField{String: "Mean Lead Time",
+			Compute: h.ProductSupplierinfo().Methods().ComputeLeadTimeStats(),
+			Help:    "Mean of the observed lead times in days."},
+		"LeadTimeP90": models.FloatField{String: "90th Percentile Lead Time",
+			Compute: h.ProductSupplierinfo().Methods().ComputeLeadTimeStats(),
+			Help:    "Nine orders out of ten have been received within this number of days."},
+		"OnTimeRate": models.FloatField{String: "On Time Rate",
+			Compute: h.ProductSupplierinfo().Methods().ComputeLeadTimeStats(),
+			Help:    "Ratio of the orders that have been received within the promised lead time."},
+	})
+
+	h.ProductSupplierinfo().Methods().ComputeLeadTimeStats().DeclareMethod(
+		`ComputeLeadTimeStats computes the statistics of the observed lead times of this vendor line.
+		The 90th percentile is computed with the nearest-rank method.`,
+		func(rs m.ProductSupplierinfoSet) m.ProductSupplierinfoData {
+			res := h.ProductSupplierinfo().NewData()
+			observations := rs.LeadTimes().Records()
+			if len(observations) == 0 {
+				return res.SetLeadTimeCount(0).SetLeadTimeMean(0).SetLeadTimeP90(0).SetOnTimeRate(0)
+			}
+			durations := make([]float64, len(observations))
+			var sum, onTime float64
+			for i, observation := range observations {
+				durations[i] = float64(observation.Duration())
+				sum += durations[i]
+				if observation.OnTime() {
+					onTime++
+				}
+			}
+			sort.Float64s(durations)
+			count := float64(len(durations))
+			rank := int(math.Ceil(0.9*count)) - 1
+			return res.
+				SetLeadTimeCount(int64(len(durations))).
+				SetLeadTimeMean(sum / count).
+				SetLeadTimeP90(durations[rank]).
+				SetOnTimeRate(onTime / count)
+		})
+
+	h.ProductSupplierinfo().Methods().ExpectedDelay().DeclareMethod(
+		`ExpectedDelay returns the mean observed lead time of this vendor line,
+		or its delivery lead time if no lead time has been observed yet.`,
+		func(rs m.ProductSupplierinfoSet) float64 {
+			rs.EnsureOne()
+			if rs.LeadTimeCount() == 0 {
+				return float64(rs.Delay())
+			}
+			return rs.LeadTimeMean()
+		})
+
+	h.ProductSupplierinfo().Methods().RecordLeadTime().DeclareMethod(
+		`RecordLeadTime stores an observed lead time of this vendor line for an order confirmed
+		at orderDate and received at receiptDate. reference is the optional reference of the order.
+
+		If AutoDelay is set, the delivery lead time of the line is updated from the statistics.`,
+		func(rs m.ProductSupplierinfoSet, orderDate, receiptDate dates.Date, reference string) m.ProductSupplierinfoLeadTimeSet {
+			rs.EnsureOne()
+			observation := h.ProductSupplierinfoLeadTime().Create(rs.Env(), h.ProductSupplierinfoLeadTime().NewData().
+				SetSupplierinfo(rs).
+				SetOrderDate(orderDate).
+				SetReceiptDate(receiptDate).
+				SetReference(reference))
+			if rs.AutoDelay() {
+				rs.UpdateDelay()
+			}
+			return observation
+		})
+
+	h.ProductSupplierinfo().Methods().UpdateDelay().DeclareMethod(
+		`UpdateDelay sets the delivery lead time of the vendor lines of this set that have observed
+		lead times to the 90th percentile of these lead times rounded up to the next day.`,
+		func(rs m.ProductSupplierinfoSet) {
+			for _, seller := range rs.Records() {
+				if seller.LeadTimeCount() == 0 {
+					continue
+				}
+				seller.SetDelay(int64(math.Ceil(seller.LeadTimeP90())))
+			}
+		})
+
+	h.ProductProduct().Methods().RecordVendorLeadTime().DeclareMethod(
+		`RecordVendorLeadTime stores an observed lead time for this product bought from the given vendor.
+		The observation is attached to the first active vendor line of this vendor that was valid at
+		orderDate, whatever its minimal quantity. It returns an empty recordset if no vendor line matches.`,
+		func(rs m.ProductProductSet, partner m.PartnerSet, orderDate, receiptDate dates.Date, reference string) m.ProductSupplierinfoLeadTimeSet {
+			rs.EnsureOne()
+			for _, seller := range rs.Sellers().Records() {
+				if !seller.Active() {
+					continue
+				}
+				if seller.Name().Intersect(partner.Union(partner.Parent())).IsEmpty() {
+					continue
+				}
+				if !seller.DateStart().IsZero() && seller.DateStart().Greater(orderDate) {
+					continue
+				}
+				if !seller.DateEnd().IsZero() && seller.DateEnd().Lower(orderDate) {
+					continue
+				}
+				if !seller.Product().IsEmpty() && !seller.Product().Equals(rs) {
+					continue
+				}
+				return seller.RecordLeadTime(orderDate, receiptDate, reference)
+			}
+			return h.ProductSupplierinfoLeadTime().NewSet(rs.Env())
+		})
+
+}
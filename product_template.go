@@ -5,9 +5,13 @@ package product
 
 import (
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/hexya-addons/base"
 	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-addons/product/producttypes"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/operator"
 	"github.com/hexya-erp/hexya/src/models/security"
@@ -37,16 +41,20 @@ This description will be copied to every Purchase Order, Receipt and Vendor Bill
 			Help: `A description of the Product that you want to communicate to your customers.
 This description will be copied to every Sale Order, Delivery Order and Customer Invoice/Refund`},
 		"Type": models.SelectionField{String: "Product Type", Selection: types.Selection{
-			"consu":   "Consumable",
-			"service": "Service",
+			"consu":        "Consumable",
+			"service":      "Service",
+			"digital":      "Digital Content",
+			"subscription": "Subscription",
 		}, Default: models.DefaultValue("consu"), Required: true,
+			Constraint: h.ProductTemplate().Methods().CheckTypeData(),
+			OnChange:   h.ProductTemplate().Methods().OnchangeType(),
 			Help: `A stockable product is a product for which you manage stock. The "Inventory" app has to be installed.
 - A consumable product on the other hand is a product for which stock is not managed.
 - A service is a non-material product you provide.
 - A digital content is a non-material product you sell online.
 	The files attached to the products are the one that are sold on
 	the e-commerce such as e-books, music, pictures,...
-	The "Digital Product" module has to be installed.`},
+- A subscription is a non-material product that is billed periodically.`},
 		"Rental": models.BooleanField{String: "Can be Rent"},
 		"Category": models.Many2OneField{String: "Internal Category", RelationModel: h.ProductCategory(),
 			Default: func(env models.Environment) interface{} {
@@ -90,7 +98,14 @@ This description will be copied to every Sale Order, Delivery Order and Customer
 			Inverse: h.ProductTemplate().Methods().InverseWeight(),
 			Digits:  decimalPrecision.GetPrecision("Stock Weight"), Stored: true,
 			Help: "The weight of the contents in Kg, not including any packaging, etc."},
-		"Warranty": models.FloatField{},
+		"Warranty": models.FloatField{Constraint: h.ProductTemplate().Methods().CheckWarranty(),
+			Help: "Duration of the warranty of this product, expressed in the warranty unit."},
+		"WarrantyUom": models.Many2OneField{String: "Warranty Unit", RelationModel: h.ProductUom(),
+			Filter: q.ProductUom().CategoryFilteredOn(q.ProductUomCategory().HexyaExternalID().Equals("product_uom_categ_wtime")),
+			Default: func(env models.Environment) interface{} {
+				return h.ProductUom().NewSet(env).GetRecord("product_product_uom_month")
+			}, Constraint: h.ProductTemplate().Methods().CheckWarranty(),
+			Help: "Time unit of the warranty. Warranties without unit are expressed in months."},
 		"SaleOk": models.BooleanField{String: "Can be Sold", Default: models.DefaultValue(true),
 			Help: "Specify if the product can be selected in a sales order line."},
 		"PurchaseOk": models.BooleanField{String: "Can be Purchased", Default: models.DefaultValue(true)},
@@ -130,6 +145,8 @@ the picking order and is mainly used if you use the EDI module.`},
 		"ProductVariantCount": models.IntegerField{String: "# Product Variants",
 			Compute: h.ProductTemplate().Methods().ComputeProductVariantCount(),
 			Depends: []string{"ProductVariants"}, GoType: new(int)},
+		"MaxVariants": models.IntegerField{String: "Maximum Variants",
+			Help: "Maximum number of active variants of this product. Keep 0 to use the limit of the company."},
 		"Barcode": models.CharField{},
 		"DefaultCode": models.CharField{String: "Internal Reference",
 			Compute: h.ProductTemplate().Methods().ComputeDefaultCode(),
@@ -443,9 +460,22 @@ Use this field anywhere a small image is required.`},
 		})
 
 	h.ProductTemplate().Methods().CreateVariants().DeclareMethod(
-		`CreateVariants`,
+		`CreateVariants creates, reactivates, deletes or archives the variants of the templates
+		of this set so that they match the possible combinations of their attribute values,
+		as reported by PreviewVariants.
+
+		Variants are created, reactivated, archived and deleted with a single call per template.
+
+		It panics before changing anything if a template would get more active variants
+		than its variant limit.`,
 		func(rs m.ProductTemplateSet) {
 			for _, tmpl := range rs.WithContext("active_test", false).Records() {
+				preview := tmpl.PreviewVariants()
+				if limit := tmpl.VariantLimit(); limit > 0 && preview.VariantCount > limit {
+					log.Panic(rs.T("Product %s would have %d variants, which is more than the limit of %d variants",
+						tmpl.Name(), preview.VariantCount, limit))
+				}
+
 				// adding an attribute with only one value should not recreate product
 				// write this attribute on every product to make sure we don't lose them
 				variantAloneLines := tmpl.AttributeLines().Filtered(func(r m.ProductAttributeLineSet) bool {
@@ -453,100 +483,390 @@ Use this field anywhere a small image is required.`},
 				})
 				for _, v := range variantAloneLines.Records() {
 					value := v.Values()
-					updatedProducts := tmpl.ProductVariants().Filtered(func(r m.ProductProductSet) bool {
-						prodAttrs := h.ProductAttribute().NewSet(rs.Env())
-						for _, pa := range r.AttributeValues().Records() {
-							prodAttrs = prodAttrs.Union(pa.Attribute())
+					withAttribute := make(map[int64]bool)
+					for _, id := range h.ProductProduct().NewSet(tmpl.Env()).WithContext("active_test", false).Search(
+						q.ProductProduct().ProductTmpl().Equals(tmpl).
+							And().AttributeValuesFilteredOn(q.ProductAttributeValue().Attribute().Equals(value.Attribute()))).Ids() {
+						withAttribute[id] = true
+					}
+					for _, prod := range tmpl.ProductVariants().Records() {
+						if withAttribute[prod.ID()] {
+							continue
 						}
-						return value.Attribute().Intersect(prodAttrs).IsEmpty()
-					})
-					for _, prod := range updatedProducts.Records() {
 						prod.SetAttributeValues(prod.AttributeValues().Union(value))
 					}
 				}
 
-				// list of values combination
-				var existingVariants []m.ProductAttributeValueSet
-				for _, prod := range tmpl.ProductVariants().Records() {
-					prodVariant := h.ProductAttributeValue().NewSet(rs.Env())
-					for _, attrVal := range prod.AttributeValues().Records() {
-						if attrVal.Attribute().CreateVariant() {
-							prodVariant = prodVariant.Union(attrVal)
-						}
+				if len(preview.ToActivate) > 0 {
+					h.ProductProduct().Browse(rs.Env(), preview.ToActivate).SetActive(true)
+				}
+
+				// create new products with a single write of the variants of the template
+				if len(preview.ToCreate) > 0 {
+					newVariants := h.ProductTemplate().NewData()
+					for _, valueIds := range preview.ToCreate {
+						newVariants.CreateProductVariants(h.ProductProduct().NewData().
+							SetAttributeValues(h.ProductAttributeValue().Browse(rs.Env(), valueIds)))
 					}
-					existingVariants = append(existingVariants, prodVariant)
+					tmpl.Write(newVariants)
 				}
-				var matrixValues []m.ProductAttributeValueSet
-				for _, attrLine := range tmpl.AttributeLines().Records() {
-					if !attrLine.Attribute().CreateVariant() {
-						continue
+
+				// unlink or inactive product
+				if len(preview.ToDeactivate) > 0 {
+					h.ProductProduct().Browse(rs.Env(), preview.ToDeactivate).SetActive(false)
+				}
+				if len(preview.ToUnlink) > 0 {
+					h.ProductProduct().Browse(rs.Env(), preview.ToUnlink).UnlinkOrDeactivate()
+				}
+			}
+		})
+
+	h.ProductTemplate().Methods().PreviewVariants().DeclareMethod(
+		`PreviewVariants returns the variants that CreateVariants would create, reactivate, delete
+		or archive for this template, without changing anything.
+
+		Variants that are not possible anymore are deleted, unless they are still in use
+		(see ProductProduct.UsedProducts), in which case they are archived. Templates with dynamic
+		attributes only get their impossible variants removed, since their variants are created
+		on demand by GetOrCreateVariant.
+
+		Archived attribute values are not used for new combinations, but the existing variants
+		using them are left unchanged.
+
+		Combinations are compared through their sorted attribute value IDs, and the attribute values
+		of the existing variants are read with one query per attribute value of the template.`,
+		func(rs m.ProductTemplateSet) producttypes.VariantsPreview {
+			rs.EnsureOne()
+			var res producttypes.VariantsPreview
+
+			var lines []m.ProductAttributeLineSet
+			lineValues := h.ProductAttributeValue().NewSet(rs.Env())
+			aloneValues := make(map[int64]int64)
+			valueAttributes := make(map[int64]int64)
+			archivedValues := make(map[int64]bool)
+			for _, line := range rs.AttributeLines().Records() {
+				if !line.Attribute().CreateVariant() {
+					continue
+				}
+				lines = append(lines, line)
+				lineValues = lineValues.Union(line.Values())
+				for _, value := range line.Values().Records() {
+					valueAttributes[value.ID()] = line.Attribute().ID()
+					if !value.Active() {
+						archivedValues[value.ID()] = true
 					}
-					matrixValues = append(matrixValues, attrLine.Values())
-				}
-				var variantMatrix []m.ProductAttributeValueSet
-				if len(matrixValues) > 0 {
-					variantMatrix = matrixValues[0].CartesianProduct(matrixValues[1:]...)
-				} else {
-					variantMatrix = []m.ProductAttributeValueSet{h.ProductAttributeValue().NewSet(rs.Env())}
-				}
-
-				var toCreateVariants []m.ProductAttributeValueSet
-				for _, mVariant := range variantMatrix {
-					var exists bool
-					for _, eVariant := range existingVariants {
-						if mVariant.Equals(eVariant) {
-							exists = true
-							break
+				}
+				if line.Values().Len() == 1 {
+					aloneValues[line.Attribute().ID()] = line.Values().ID()
+				}
+			}
+			exclusions := make(map[int64][]int64)
+			for _, rule := range rs.VariantExclusions().Records() {
+				exclusions[rule.Value().ID()] = append(exclusions[rule.Value().ID()], rule.ExcludedValues().Ids()...)
+			}
+			excluded := func(valueIds []int64) bool {
+				inCombination := make(map[int64]bool, len(valueIds))
+				for _, id := range valueIds {
+					inCombination[id] = true
+				}
+				for _, id := range valueIds {
+					for _, excludedID := range exclusions[id] {
+						if inCombination[excludedID] {
+							return true
 						}
 					}
-					if !exists {
-						toCreateVariants = append(toCreateVariants, mVariant)
+				}
+				return false
+			}
+			archived := func(valueIds []int64) bool {
+				for _, id := range valueIds {
+					if archivedValues[id] {
+						return true
+					}
+				}
+				return false
+			}
+
+			// read the attribute values of the existing variants, archived ones included
+			variants := h.ProductProduct().NewSet(rs.Env()).WithContext("active_test", false)
+			variantIds := rs.ProductVariants().Ids()
+			active := make(map[int64]bool)
+			for _, id := range variants.Search(
+				q.ProductProduct().ProductTmpl().Equals(rs).And().Active().Equals(true)).Ids() {
+				active[id] = true
+			}
+			variantValues := make(map[int64][]int64)
+			for _, value := range lineValues.Records() {
+				for _, id := range variants.Search(
+					q.ProductProduct().ProductTmpl().Equals(rs).And().AttributeValues().Equals(value)).Ids() {
+					variantValues[id] = append(variantValues[id], value.ID())
+				}
+			}
+			// variants with values that are not in the attribute lines anymore are never possible
+			otherValuesCond := q.ProductAttributeValue().AttributeFilteredOn(q.ProductAttribute().CreateVariant().Equals(true))
+			if !lineValues.IsEmpty() {
+				otherValuesCond = otherValuesCond.And().ID().NotIn(lineValues.Ids())
+			}
+			invalid := make(map[int64]bool)
+			for _, id := range variants.Search(
+				q.ProductProduct().ProductTmpl().Equals(rs).And().AttributeValuesFilteredOn(otherValuesCond)).Ids() {
+				invalid[id] = true
+			}
+			// values of attribute lines with a single value are added by CreateVariants to the variants
+			// that have no value for this attribute
+			for _, id := range variantIds {
+				if invalid[id] {
+					continue
+				}
+				variantAttributes := make(map[int64]bool)
+				for _, valueID := range variantValues[id] {
+					variantAttributes[valueAttributes[valueID]] = true
+				}
+				for attrID, valueID := range aloneValues {
+					if !variantAttributes[attrID] {
+						variantValues[id] = append(variantValues[id], valueID)
 					}
 				}
+			}
 
-				// check product
-				variantsToActivate := h.ProductProduct().NewSet(rs.Env())
-				variantsToUnlink := h.ProductProduct().NewSet(rs.Env())
-				for _, product := range tmpl.ProductVariants().Records() {
-					tcAttrs := h.ProductAttributeValue().NewSet(rs.Env())
-					for _, attrVal := range product.AttributeValues().Records() {
-						if !attrVal.Attribute().CreateVariant() {
-							continue
+			var toRemove []int64
+			if rs.HasDynamicAttributes() {
+				for _, id := range variantIds {
+					variantAttributes := make(map[int64]bool)
+					for _, valueID := range variantValues[id] {
+						variantAttributes[valueAttributes[valueID]] = true
+					}
+					possible := !invalid[id] && len(variantValues[id]) == len(lines) &&
+						len(variantAttributes) == len(lines) && !excluded(variantValues[id])
+					switch {
+					case possible && archived(variantValues[id]):
+						// variant of an archived value, we keep it as is
+						if active[id] {
+							res.VariantCount++
 						}
-						tcAttrs = tcAttrs.Union(attrVal)
+					case !possible:
+						toRemove = append(toRemove, id)
+					case active[id]:
+						res.VariantCount++
 					}
-					var inMatrix bool
-					for _, mVariant := range variantMatrix {
-						if tcAttrs.Equals(mVariant) {
-
-							inMatrix = true
-							break
+				}
+			} else {
+				// build the matrix of the possible combinations
+				matrix := [][]int64{{}}
+				for _, line := range lines {
+					var valueIds []int64
+					for _, valueID := range line.Values().Ids() {
+						if !archivedValues[valueID] {
+							valueIds = append(valueIds, valueID)
+						}
+					}
+					next := make([][]int64, 0, len(matrix)*len(valueIds))
+					for _, combination := range matrix {
+						for _, valueID := range valueIds {
+							newCombination := make([]int64, len(combination)+1)
+							copy(newCombination, combination)
+							newCombination[len(combination)] = valueID
+							next = append(next, newCombination)
 						}
 					}
+					matrix = next
+				}
+				matrixIndex := make(map[string]int, len(matrix))
+				var possibleCombinations [][]int64
+				for _, combination := range matrix {
+					if excluded(combination) {
+						continue
+					}
+					matrixIndex[variantKey(combination)] = len(possibleCombinations)
+					possibleCombinations = append(possibleCombinations, combination)
+				}
+
+				// check product
+				existing := make([]bool, len(possibleCombinations))
+				for _, id := range variantIds {
+					index, inMatrix := matrixIndex[variantKey(variantValues[id])]
 					switch {
-					case inMatrix && !product.Active():
-						variantsToActivate = variantsToActivate.Union(product)
-					case !inMatrix:
-						variantsToUnlink = variantsToUnlink.Union(product)
+					case !invalid[id] && archived(variantValues[id]) && len(variantValues[id]) == len(lines) &&
+						!excluded(variantValues[id]):
+						// variant of an archived value, we keep it as is
+						if active[id] {
+							res.VariantCount++
+						}
+					case invalid[id] || !inMatrix:
+						toRemove = append(toRemove, id)
+					case existing[index]:
+						// duplicate variant of an existing combination, we keep it as is
+						if active[id] {
+							res.VariantCount++
+						}
+					default:
+						existing[index] = true
+						res.VariantCount++
+						if !active[id] {
+							res.ToActivate = append(res.ToActivate, id)
+						}
 					}
 				}
-				if !variantsToActivate.IsEmpty() {
-					variantsToActivate.SetActive(true)
+				for i, combination := range possibleCombinations {
+					if existing[i] {
+						continue
+					}
+					sorted := make([]int64, len(combination))
+					copy(sorted, combination)
+					sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+					res.ToCreate = append(res.ToCreate, sorted)
+					res.VariantCount++
 				}
+			}
 
-				// create new product
-				for _, variants := range toCreateVariants {
-					h.ProductProduct().Create(rs.Env(), h.ProductProduct().NewData().
-						SetProductTmpl(tmpl).
-						SetAttributeValues(variants))
+			if len(toRemove) == 0 {
+				return res
+			}
+			used := make(map[int64]bool)
+			for _, id := range h.ProductProduct().Browse(rs.Env(), toRemove).UsedProducts().Ids() {
+				used[id] = true
+			}
+			for _, id := range toRemove {
+				switch {
+				case !used[id]:
+					res.ToUnlink = append(res.ToUnlink, id)
+				case active[id]:
+					res.ToDeactivate = append(res.ToDeactivate, id)
 				}
+			}
+			return res
+		})
 
-				// unlink or inactive product
-				if !variantsToUnlink.IsEmpty() {
-					variantsToUnlink.UnlinkOrDeactivate()
+	h.ProductTemplate().Methods().VariantLimit().DeclareMethod(
+		`VariantLimit returns the maximum number of active variants of this template,
+		that is its own limit if set or the limit of its company. 0 means no limit.`,
+		func(rs m.ProductTemplateSet) int {
+			rs.EnsureOne()
+			if rs.MaxVariants() > 0 {
+				return int(rs.MaxVariants())
+			}
+			company := rs.Company()
+			if company.IsEmpty() {
+				company = h.User().NewSet(rs.Env()).CurrentUser().Company()
+			}
+			return int(company.MaxVariants())
+		})
+
+	h.ProductProduct().Methods().UsedProducts().DeclareMethod(
+		`UsedProducts returns the products of this set that are referenced by other records
+		and should be archived instead of deleted when they are not possible variants anymore.
+
+		This implementation returns kit components. Modules referencing variants should extend it.`,
+		func(rs m.ProductProductSet) m.ProductProductSet {
+			res := h.ProductProduct().NewSet(rs.Env())
+			if rs.IsEmpty() {
+				return res
+			}
+			for _, line := range h.ProductKitLine().Search(rs.Env(), q.ProductKitLine().Product().In(rs)).Records() {
+				res = res.Union(line.Product())
+			}
+			return res
+		})
+
+	h.ProductTemplate().Methods().HasDynamicAttributes().DeclareMethod(
+		`HasDynamicAttributes returns true if the variants of this template are created dynamically,
+		that is if one of its attributes has the dynamic creation mode.`,
+		func(rs m.ProductTemplateSet) bool {
+			rs.EnsureOne()
+			for _, line := range rs.AttributeLines().Records() {
+				if line.Attribute().CreateVariantMode() == "dynamic" {
+					return true
 				}
+			}
+			return false
+		})
 
+	h.ProductTemplate().Methods().IsCombinationPossible().DeclareMethod(
+		`IsCombinationPossible returns true if a variant of this template can have the given attribute values,
+		that is if they contain exactly one value of each attribute line creating variants, if they are
+		not excluded by an exclusion rule and if none of them is archived. Values of attributes that do
+		not create variants are ignored.`,
+		func(rs m.ProductTemplateSet, values m.ProductAttributeValueSet) bool {
+			rs.EnsureOne()
+			remaining := values.Filtered(func(r m.ProductAttributeValueSet) bool {
+				return r.Attribute().CreateVariant()
+			})
+			variantValues := remaining
+			if !variantValues.Filtered(func(r m.ProductAttributeValueSet) bool { return !r.Active() }).IsEmpty() {
+				return false
+			}
+			for _, line := range rs.AttributeLines().Records() {
+				if !line.Attribute().CreateVariant() {
+					continue
+				}
+				lineValues := line.Values().Intersect(remaining)
+				if lineValues.Len() != 1 {
+					return false
+				}
+				remaining = remaining.Subtract(lineValues)
+			}
+			if !remaining.IsEmpty() {
+				return false
 			}
+			return !rs.IsCombinationExcluded(variantValues)
 		})
 
+	h.ProductTemplate().Methods().GetOrCreateVariant().DeclareMethod(
+		`GetOrCreateVariant returns the variant of this template with the given attribute values,
+		creating it if it does not exist yet and reactivating it if it was archived. Values of
+		attributes that do not create variants are ignored. It panics if the combination is not possible
+		or if a new or reactivated variant would exceed the variant limit of this template.
+
+		The template row is locked until the end of the transaction so that concurrent callers
+		asking for the same combination wait for each other instead of creating duplicates.`,
+		func(rs m.ProductTemplateSet, values m.ProductAttributeValueSet) m.ProductProductSet {
+			rs.EnsureOne()
+			if !rs.IsCombinationPossible(values) {
+				log.Panic(rs.T("This combination of attribute values is not available for product %s", rs.Name()))
+			}
+			variantValues := values.Filtered(func(r m.ProductAttributeValueSet) bool {
+				return r.Attribute().CreateVariant()
+			})
+			rs.Env().Cr().Execute(`SELECT id FROM product_template WHERE id=? FOR UPDATE`, rs.ID())
+			checkLimit := func() {
+				activeCount := h.ProductProduct().Search(rs.Env(),
+					q.ProductProduct().ProductTmpl().Equals(rs).And().Active().Equals(true)).SearchCount()
+				if limit := rs.VariantLimit(); limit > 0 && activeCount >= limit {
+					log.Panic(rs.T("Product %s cannot have more than %d variants", rs.Name(), limit))
+				}
+			}
+			existing := h.ProductProduct().NewSet(rs.Env()).WithContext("active_test", false).Search(
+				q.ProductProduct().ProductTmpl().Equals(rs))
+			for _, product := range existing.Records() {
+				productValues := product.AttributeValues().Filtered(func(r m.ProductAttributeValueSet) bool {
+					return r.Attribute().CreateVariant()
+				})
+				if !productValues.Equals(variantValues) {
+					continue
+				}
+				if !product.Active() {
+					checkLimit()
+					product.SetActive(true)
+				}
+				return product
+			}
+			checkLimit()
+			return h.ProductProduct().Create(rs.Env(), h.ProductProduct().NewData().
+				SetProductTmpl(rs).
+				SetAttributeValues(variantValues))
+		})
+
+}
+
+// variantKey returns a canonical key for the combination of the given attribute value IDs,
+// whatever their order.
+func variantKey(valueIds []int64) string {
+	sorted := make([]int64, len(valueIds))
+	copy(sorted, valueIds)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	keys := make([]string, len(sorted))
+	for i, id := range sorted {
+		keys[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(keys, ",")
 }
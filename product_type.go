@@ -0,0 +1,170 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+func init() {
+
+	h.ProductTemplate().AddFields(map[string]models.FieldDefinition{
+		"DigitalAttachments": models.Many2ManyField{String: "Downloadable Files", RelationModel: h.Attachment(),
+			JSON: "digital_attachment_ids", Constraint: h.ProductTemplate().Methods().CheckTypeData(),
+			Help: "Files made available to the customers who buy this digital product."},
+		"SubscriptionPeriod": models.SelectionField{String: "Billing Period", Selection: types.Selection{
+			"day":   "Day(s)",
+			"week":  "Week(s)",
+			"month": "Month(s)",
+			"year":  "Year(s)",
+		}, Constraint: h.ProductTemplate().Methods().CheckTypeData()},
+		"SubscriptionInterval": models.IntegerField{String: "Billing Interval", Default: models.DefaultValue(1),
+			Constraint: h.ProductTemplate().Methods().CheckTypeData(),
+			Help:       "Number of billing periods between two invoices of this subscription."},
+		"TrialDays": models.IntegerField{String: "Trial Length (days)",
+			Constraint: h.ProductTemplate().Methods().CheckTypeData(),
+			Help:       "Number of days during which this subscription is free before the first invoice."},
+	})
+
+	h.ProductTemplate().Methods().CheckTypeData().DeclareMethod(
+		`CheckTypeData checks that the data of this product is consistent with its type:
+
+		- digital contents and subscriptions cannot have a weight or a volume,
+		- only digital contents can have downloadable files,
+		- only subscriptions can have a billing period and a trial, and subscriptions must have
+		  a billing period and a positive billing interval.`,
+		func(rs m.ProductTemplateSet) {
+			for _, tmpl := range rs.Records() {
+				if tmpl.Type() == "digital" || tmpl.Type() == "subscription" {
+					for _, product := range tmpl.ProductVariants().Records() {
+						if product.Weight() != 0 || product.Volume() != 0 {
+							log.Panic(rs.T("Error: A digital content or a subscription cannot have a weight or a volume."))
+						}
+					}
+				}
+				if tmpl.Type() != "digital" && !tmpl.DigitalAttachments().IsEmpty() {
+					log.Panic(rs.T("Error: Only digital contents can have downloadable files."))
+				}
+				if tmpl.Type() != "subscription" {
+					if tmpl.SubscriptionPeriod() != "" || tmpl.TrialDays() != 0 {
+						log.Panic(rs.T("Error: Only subscriptions can have a billing period or a trial."))
+					}
+					continue
+				}
+				if tmpl.SubscriptionPeriod() == "" {
+					log.Panic(rs.T("Error: A subscription must have a billing period."))
+				}
+				if tmpl.SubscriptionInterval() < 1 {
+					log.Panic(rs.T("Error: The billing interval of a subscription must be at least 1."))
+				}
+				if tmpl.TrialDays() < 0 {
+					log.Panic(rs.T("Error: The trial length of a subscription cannot be negative."))
+				}
+			}
+		})
+
+	h.ProductProduct().Methods().CheckTypeData().DeclareMethod(
+		`CheckTypeData checks that the data of this product is consistent with the type of its template.`,
+		func(rs m.ProductProductSet) {
+			rs.ProductTmpl().CheckTypeData()
+		})
+
+	h.ProductTemplate().Methods().OnchangeType().DeclareMethod(
+		`OnchangeType resets the data that does not apply to the new type of this product.`,
+		func(rs m.ProductTemplateSet) m.ProductTemplateData {
+			res := h.ProductTemplate().NewData()
+			if rs.Type() == "digital" || rs.Type() == "subscription" {
+				res.SetWeight(0).SetVolume(0)
+			}
+			if rs.Type() != "digital" {
+				res.SetDigitalAttachments(h.Attachment().NewSet(rs.Env()))
+			}
+			switch {
+			case rs.Type() != "subscription":
+				res.SetSubscriptionPeriod("").SetTrialDays(0)
+			case rs.SubscriptionPeriod() == "":
+				res.SetSubscriptionPeriod("month")
+			}
+			return res
+		})
+
+	h.ProductTemplate().Methods().Create().Extend("",
+		func(rs m.ProductTemplateSet, data m.ProductTemplateData) m.ProductTemplateSet {
+			if data.Type() == "subscription" && !data.HasSubscriptionPeriod() {
+				data.SetSubscriptionPeriod("month")
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.ProductTemplate().Methods().IsPhysical().DeclareMethod(
+		`IsPhysical returns true if this product is a material good that has to be delivered,
+		i.e. if it is neither a service, a digital content nor a subscription.`,
+		func(rs m.ProductTemplateSet) bool {
+			rs.EnsureOne()
+			return !(rs.Type() == "service" || rs.IsDigital() || rs.IsSubscription())
+		})
+
+	h.ProductTemplate().Methods().IsDigital().DeclareMethod(
+		`IsDigital returns true if this product is a digital content.`,
+		func(rs m.ProductTemplateSet) bool {
+			rs.EnsureOne()
+			return rs.Type() == "digital"
+		})
+
+	h.ProductTemplate().Methods().IsSubscription().DeclareMethod(
+		`IsSubscription returns true if this product is a subscription.`,
+		func(rs m.ProductTemplateSet) bool {
+			rs.EnsureOne()
+			return rs.Type() == "subscription"
+		})
+
+	h.ProductTemplate().Methods().DigitalFiles().DeclareMethod(
+		`DigitalFiles returns the files to make available to the customers who buy this product.
+		It returns an empty set if this product is not a digital content.`,
+		func(rs m.ProductTemplateSet) m.AttachmentSet {
+			if !rs.IsDigital() {
+				return h.Attachment().NewSet(rs.Env())
+			}
+			return rs.DigitalAttachments()
+		})
+
+	h.ProductTemplate().Methods().SubscriptionTrialEnd().DeclareMethod(
+		`SubscriptionTrialEnd returns the date at which the trial of a subscription starting at
+		the given date ends, that is the date of its first invoice.`,
+		func(rs m.ProductTemplateSet, start dates.Date) dates.Date {
+			rs.EnsureOne()
+			if !rs.IsSubscription() {
+				log.Panic(rs.T("Product %s is not a subscription", rs.Name()))
+			}
+			return start.AddDate(0, 0, int(rs.TrialDays()))
+		})
+
+	h.ProductTemplate().Methods().SubscriptionNextDate().DeclareMethod(
+		`SubscriptionNextDate returns the billing date of this subscription that follows the given one.
+		Monthly and yearly periods end on the last day of the target month if it is shorter.`,
+		func(rs m.ProductTemplateSet, from dates.Date) dates.Date {
+			rs.EnsureOne()
+			if !rs.IsSubscription() {
+				log.Panic(rs.T("Product %s is not a subscription", rs.Name()))
+			}
+			interval := int(rs.SubscriptionInterval())
+			switch rs.SubscriptionPeriod() {
+			case "day":
+				return from.AddDate(0, 0, interval)
+			case "week":
+				return from.AddDate(0, 0, 7*interval)
+			case "month":
+				return addMonths(from, interval)
+			default:
+				return addMonths(from, 12*interval)
+			}
+		})
+
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"testing"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProductTypes(t *testing.T) {
+	Convey("Testing digital and subscription products", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			Convey("Subscriptions should compute their billing dates", func() {
+				magazine := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+					SetName("Magazine").
+					SetType("subscription").
+					SetTrialDays(14))
+				So(magazine.IsSubscription(), ShouldBeTrue)
+				So(magazine.IsPhysical(), ShouldBeFalse)
+				So(magazine.SubscriptionPeriod(), ShouldEqual, "month")
+				start := dates.ParseDate("2026-01-15")
+				So(magazine.SubscriptionTrialEnd(start).Equal(dates.ParseDate("2026-01-29")), ShouldBeTrue)
+				So(magazine.SubscriptionNextDate(start).Equal(dates.ParseDate("2026-02-15")), ShouldBeTrue)
+				So(magazine.SubscriptionNextDate(dates.ParseDate("2026-01-31")).Equal(dates.ParseDate("2026-02-28")), ShouldBeTrue)
+				magazine.SetSubscriptionPeriod("week")
+				magazine.SetSubscriptionInterval(3)
+				So(magazine.SubscriptionNextDate(start).Equal(dates.ParseDate("2026-02-05")), ShouldBeTrue)
+				So(func() { magazine.SetSubscriptionInterval(0) }, ShouldPanic)
+				So(func() { magazine.ProductVariant().SetWeight(2) }, ShouldPanic)
+				So(magazine.OnchangeType().HasWeight(), ShouldBeTrue)
+				So(func() { ptd.product1.ProductTmpl().SubscriptionNextDate(start) }, ShouldPanic)
+			})
+			Convey("Digital contents should have downloadable files", func() {
+				ebook := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+					SetName("E-Book").
+					SetType("digital"))
+				file := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("ebook.pdf"))
+				ebook.SetDigitalAttachments(file)
+				So(ebook.IsDigital(), ShouldBeTrue)
+				So(ebook.IsPhysical(), ShouldBeFalse)
+				So(ptd.product1.ProductTmpl().IsPhysical(), ShouldBeTrue)
+				So(ebook.DigitalFiles().Equals(file), ShouldBeTrue)
+				So(ptd.product1.ProductTmpl().DigitalFiles().IsEmpty(), ShouldBeTrue)
+				So(func() { ptd.product1.ProductTmpl().SetDigitalAttachments(file) }, ShouldPanic)
+			})
+			Convey("Type specific data should be checked and reset", func() {
+				So(func() { ptd.product1.SetSubscriptionPeriod("week") }, ShouldPanic)
+				ptd.product1.SetWeight(3)
+				So(func() { ptd.product1.SetType("digital") }, ShouldPanic)
+				res := ptd.product1.ProductTmpl().OnchangeType()
+				So(res.HasWeight(), ShouldBeFalse)
+				So(res.HasSubscriptionPeriod(), ShouldBeTrue)
+				So(res.SubscriptionPeriod(), ShouldEqual, "")
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -5,12 +5,14 @@ package product
 
 import (
 	"log"
+	"strings"
 
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/types"
 	"github.com/hexya-erp/hexya/src/tools/nbutils"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
 )
 
 func init() {
@@ -19,6 +21,8 @@ func init() {
 
 	h.ProductUomCategory().AddFields(map[string]models.FieldDefinition{
 		"Name": models.CharField{String: "Name", Required: true, Translate: true},
+		"Uoms": models.One2ManyField{String: "Units of Measure", RelationModel: h.ProductUom(),
+			ReverseFK: "Category", JSON: "uom_ids"},
 	})
 
 	h.ProductUom().DeclareModel()
@@ -48,6 +52,10 @@ Use 1.0 for a Unit of Measure that cannot be further split, such as a piece.`},
 			"smaller":   "Smaller than the reference Unit of Measure",
 		}, Default: models.DefaultValue("reference"), Required: true,
 			OnChange: h.ProductUom().Methods().OnchangeUomType()},
+		"UneceCode": models.CharField{String: "UN/ECE Code", Index: true,
+			Help: "Code of this unit in the UN/ECE Recommendation 20, used in EDI and electronic invoicing (e.g. KGM, C62)."},
+		"UcumCode": models.CharField{String: "UCUM Code", Index: true,
+			Help: "Code of this unit in the Unified Code for Units of Measure (e.g. kg, [lb_av]). This code is case sensitive."},
 	})
 
 	h.ProductUom().AddSQLConstraint("FactorGtZero", "CHECK (factor!=0)", "The conversion ratio for a unit of measure cannot be 0!")
@@ -96,6 +104,48 @@ Use 1.0 for a Unit of Measure that cannot be further split, such as a piece.`},
 			return rs.Super().Write(vals)
 		})
 
+	h.ProductUomCategory().Methods().ReferenceUom().DeclareMethod(
+		`ReferenceUom returns the reference unit of measure of this category,
+		or an empty set if there is none.`,
+		func(rs m.ProductUomCategorySet) m.ProductUomSet {
+			rs.EnsureOne()
+			return h.ProductUom().Search(rs.Env(),
+				q.ProductUom().Category().Equals(rs).And().UomType().Equals("reference")).Limit(1)
+		})
+
+	h.ProductUom().Methods().GetByUneceCode().DeclareMethod(
+		`GetByUneceCode returns the active unit of measure with the given UN/ECE Recommendation 20 code.
+		If category is not empty, only units of this category are considered.
+
+		It returns an empty set if no unit matches.`,
+		func(rs m.ProductUomSet, code string, category m.ProductUomCategorySet) m.ProductUomSet {
+			cond := q.ProductUom().UneceCode().Equals(strings.ToUpper(strings.TrimSpace(code)))
+			if !category.IsEmpty() {
+				cond = cond.And().Category().In(category)
+			}
+			return h.ProductUom().Search(rs.Env(), cond).OrderBy("ID").Limit(1)
+		})
+
+	h.ProductUom().Methods().GetByUcumCode().DeclareMethod(
+		`GetByUcumCode returns the active unit of measure with the given UCUM code.
+		UCUM codes are case sensitive. If category is not empty, only units of this
+		category are considered.
+
+		It returns an empty set if no unit matches.`,
+		func(rs m.ProductUomSet, code string, category m.ProductUomCategorySet) m.ProductUomSet {
+			cond := q.ProductUom().UcumCode().Equals(strings.TrimSpace(code))
+			if !category.IsEmpty() {
+				cond = cond.And().Category().In(category)
+			}
+			return h.ProductUom().Search(rs.Env(), cond).OrderBy("ID").Limit(1)
+		})
+
+	h.ProductUom().Methods().GetByCategory().DeclareMethod(
+		`GetByCategory returns all the active units of measure of the given category`,
+		func(rs m.ProductUomSet, category m.ProductUomCategorySet) m.ProductUomSet {
+			return h.ProductUom().Search(rs.Env(), q.ProductUom().Category().In(category))
+		})
+
 	h.ProductUom().Methods().ComputeQuantity().DeclareMethod(
 		`ComputeQuantity converts the given qty from this UoM to toUnit UoM. If round is true,
 		the result will be rounded to toUnit rounding.
@@ -0,0 +1,205 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"math"
+
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// uomFactorTolerance is the tolerance used when checking that FactorInv
+// is the inverse of Factor and that the ratio of a reference unit is 1.
+const uomFactorTolerance = 1e-6
+
+func init() {
+
+	h.ProductUomCategory().Methods().ConversionMatrix().DeclareMethod(
+		`ConversionMatrix returns the conversion ratios between all the units of this category,
+		including archived ones. The returned map is indexed by source and target UoM IDs so that:
+
+		    qty_in_target = qty_in_source * matrix[source][target]
+
+		Ratios are computed with ComputeQuantity and are not rounded.`,
+		func(rs m.ProductUomCategorySet) map[int64]map[int64]float64 {
+			rs.EnsureOne()
+			uoms := h.ProductUom().NewSet(rs.Env()).WithContext("active_test", false).Search(
+				q.ProductUom().Category().Equals(rs))
+			res := make(map[int64]map[int64]float64)
+			for _, from := range uoms.Records() {
+				res[from.ID()] = make(map[int64]float64)
+				if from.Factor() == 0 {
+					continue
+				}
+				for _, to := range uoms.Records() {
+					res[from.ID()][to.ID()] = from.ComputeQuantity(1, to, false)
+				}
+			}
+			return res
+		})
+
+	h.ProductUomCategory().Methods().CheckConsistency().DeclareMethod(
+		`CheckConsistency audits the units of measure of this category and the products using them.
+		It returns the data of one audit line per detected issue:
+
+		- 'factor_inv' when FactorInv is not the inverse of Factor,
+		- 'factor' when the ratio of a unit does not match its type, that is when the ratio of a
+		  reference unit is not 1, a bigger unit has a ratio greater than 1 or a smaller unit
+		  has a ratio lower than 1,
+		- 'rounding' when the rounding is coarser than the unit itself,
+		- 'no_reference' when the category has no or several reference units,
+		- 'inactive_reference' when the reference unit is archived,
+		- 'category_mismatch' when a product's Uom and UomPo are in different categories.
+		  Each product is only reported once, even if both categories are audited.`,
+		func(rs m.ProductUomCategorySet) []m.ProductUomAuditLineData {
+			var res []m.ProductUomAuditLineData
+			newLine := func(categ m.ProductUomCategorySet, issue, description string) m.ProductUomAuditLineData {
+				line := h.ProductUomAuditLine().NewData().
+					SetCategory(categ).
+					SetIssue(issue).
+					SetDescription(description)
+				res = append(res, line)
+				return line
+			}
+			reportedTemplates := make(map[int64]bool)
+			for _, categ := range rs.Records() {
+				uoms := h.ProductUom().NewSet(rs.Env()).WithContext("active_test", false).Search(
+					q.ProductUom().Category().Equals(categ))
+				references := h.ProductUom().NewSet(rs.Env())
+				for _, uom := range uoms.Records() {
+					if uom.UomType() == "reference" {
+						references = references.Union(uom)
+					}
+					if math.Abs(uom.Factor()*uom.FactorInv()-1) > uomFactorTolerance {
+						newLine(categ, "factor_inv", rs.T("Bigger ratio %f is not the inverse of ratio %f",
+							uom.FactorInv(), uom.Factor())).SetUom(uom)
+					}
+					var inconsistent bool
+					switch uom.UomType() {
+					case "reference":
+						inconsistent = math.Abs(uom.Factor()-1) > uomFactorTolerance
+					case "bigger":
+						inconsistent = uom.Factor() > 1
+					case "smaller":
+						inconsistent = uom.Factor() < 1
+					}
+					if inconsistent || uom.Factor() <= 0 {
+						newLine(categ, "factor", rs.T("Ratio %f does not match the type of unit %s",
+							uom.Factor(), uom.Name())).SetUom(uom)
+					}
+					if uom.Rounding() > 1 {
+						newLine(categ, "rounding", rs.T("Rounding precision %f is coarser than one %s",
+							uom.Rounding(), uom.Name())).SetUom(uom)
+					}
+				}
+				switch {
+				case references.IsEmpty():
+					newLine(categ, "no_reference", rs.T("Category %s has no reference unit", categ.Name()))
+				case references.Len() > 1:
+					newLine(categ, "no_reference", rs.T("Category %s has %d reference units", categ.Name(), references.Len()))
+				}
+				for _, ref := range references.Records() {
+					if !ref.Active() {
+						newLine(categ, "inactive_reference", rs.T("Reference unit %s is archived", ref.Name())).SetUom(ref)
+					}
+				}
+				templates := h.ProductTemplate().NewSet(rs.Env()).WithContext("active_test", false).Search(
+					q.ProductTemplate().Uom().In(uoms).Or().UomPo().In(uoms))
+				for _, tmpl := range templates.Records() {
+					if reportedTemplates[tmpl.ID()] || tmpl.Uom().Category().Equals(tmpl.UomPo().Category()) {
+						continue
+					}
+					reportedTemplates[tmpl.ID()] = true
+					newLine(categ, "category_mismatch", rs.T("Unit of measure %s and purchase unit of measure %s are not in the same category",
+						tmpl.Uom().Name(), tmpl.UomPo().Name())).SetProductTmpl(tmpl)
+				}
+			}
+			return res
+		})
+
+	h.ProductUomAudit().DeclareTransientModel()
+
+	h.ProductUomAudit().AddFields(map[string]models.FieldDefinition{
+		"Categories": models.Many2ManyField{String: "Categories", RelationModel: h.ProductUomCategory(),
+			JSON: "category_ids", Help: "Categories to audit. Leave empty to audit all categories."},
+		"Lines": models.One2ManyField{String: "Issues", RelationModel: h.ProductUomAuditLine(),
+			ReverseFK: "Audit", JSON: "line_ids", ReadOnly: true},
+		"Conversions": models.One2ManyField{String: "Conversion Matrix", RelationModel: h.ProductUomAuditConversion(),
+			ReverseFK: "Audit", JSON: "conversion_ids", ReadOnly: true},
+	})
+
+	h.ProductUomAudit().Methods().Run().DeclareMethod(
+		`Run audits the selected categories, fills in the issues and the conversion matrix
+		of this audit and returns an action to display the results.`,
+		func(rs m.ProductUomAuditSet) *actions.Action {
+			rs.EnsureOne()
+			categories := rs.Categories()
+			if categories.IsEmpty() {
+				categories = h.ProductUomCategory().NewSet(rs.Env()).SearchAll()
+			}
+			rs.Lines().Unlink()
+			rs.Conversions().Unlink()
+			for _, line := range categories.CheckConsistency() {
+				h.ProductUomAuditLine().Create(rs.Env(), line.SetAudit(rs))
+			}
+			for _, categ := range categories.Records() {
+				for fromID, row := range categ.ConversionMatrix() {
+					for toID, ratio := range row {
+						h.ProductUomAuditConversion().Create(rs.Env(), h.ProductUomAuditConversion().NewData().
+							SetAudit(rs).
+							SetCategory(categ).
+							SetFromUom(h.ProductUom().Browse(rs.Env(), []int64{fromID})).
+							SetToUom(h.ProductUom().Browse(rs.Env(), []int64{toID})).
+							SetRatio(ratio))
+					}
+				}
+			}
+			return &actions.Action{
+				Type:     actions.ActionActWindow,
+				Model:    "ProductUomAudit",
+				ViewMode: "form",
+				ResID:    rs.ID(),
+				Target:   "new",
+			}
+		})
+
+	h.ProductUomAuditLine().DeclareTransientModel()
+	h.ProductUomAuditLine().SetDefaultOrder("Category", "Issue")
+
+	h.ProductUomAuditLine().AddFields(map[string]models.FieldDefinition{
+		"Audit":    models.Many2OneField{RelationModel: h.ProductUomAudit(), OnDelete: models.Cascade},
+		"Category": models.Many2OneField{RelationModel: h.ProductUomCategory(), Required: true},
+		"Uom":      models.Many2OneField{String: "Unit of Measure", RelationModel: h.ProductUom()},
+		"ProductTmpl": models.Many2OneField{String: "Product Template", RelationModel: h.ProductTemplate(),
+			JSON: "product_tmpl_id"},
+		"Issue": models.SelectionField{Selection: types.Selection{
+			"factor_inv":         "Inconsistent Bigger Ratio",
+			"factor":             "Ratio Inconsistent With Type",
+			"rounding":           "Rounding Coarser Than Unit",
+			"no_reference":       "Missing or Multiple Reference Units",
+			"inactive_reference": "Archived Reference Unit",
+			"category_mismatch":  "Product Units In Different Categories",
+		}, Required: true},
+		"Description": models.CharField{},
+	})
+
+	h.ProductUomAuditConversion().DeclareTransientModel()
+	h.ProductUomAuditConversion().SetDefaultOrder("Category", "FromUom", "ToUom")
+
+	h.ProductUomAuditConversion().AddFields(map[string]models.FieldDefinition{
+		"Audit":    models.Many2OneField{RelationModel: h.ProductUomAudit(), OnDelete: models.Cascade},
+		"Category": models.Many2OneField{RelationModel: h.ProductUomCategory(), Required: true},
+		"FromUom": models.Many2OneField{String: "From", RelationModel: h.ProductUom(), Required: true,
+			JSON: "from_uom_id"},
+		"ToUom": models.Many2OneField{String: "To", RelationModel: h.ProductUom(), Required: true,
+			JSON: "to_uom_id"},
+		"Ratio": models.FloatField{Help: "Quantity in the target unit for one source unit."},
+	})
+
+}
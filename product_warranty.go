@@ -0,0 +1,142 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"log"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.ProductUom().Methods().AddDuration().DeclareMethod(
+		`AddDuration returns the given date shifted by quantity units of this time unit.
+
+		Days, weeks, months and years are added with calendar arithmetic. When the target month
+		is shorter than the month of the date, the last day of the target month is returned, so
+		that one month after January 31st is the last day of February. Other time units and
+		the fractional part of the quantity are added as calendar hours.`,
+		func(rs m.ProductUomSet, date dates.Date, quantity float64) dates.Date {
+			rs.EnsureOne()
+			uoms := h.ProductUom().NewSet(rs.Env())
+			whole := int(quantity)
+			switch {
+			case rs.Equals(uoms.GetRecord("product_product_uom_day")):
+				date = date.AddDate(0, 0, whole)
+			case rs.Equals(uoms.GetRecord("product_product_uom_week")):
+				date = date.AddDate(0, 0, 7*whole)
+			case rs.Equals(uoms.GetRecord("product_product_uom_month")):
+				date = addMonths(date, whole)
+			case rs.Equals(uoms.GetRecord("product_product_uom_year")):
+				date = addMonths(date, 12*whole)
+			default:
+				whole = 0
+			}
+			hours := (quantity - float64(whole)) * rs.CalendarHours()
+			if hours == 0 {
+				return date
+			}
+			return date.ToDateTime().Add(time.Duration(hours * float64(time.Hour))).ToDate()
+		})
+
+	h.ProductTemplate().Methods().CheckWarranty().DeclareMethod(
+		`CheckWarranty checks that the warranty of this product is not negative and expressed in a time unit.`,
+		func(rs m.ProductTemplateSet) {
+			wtime := h.ProductUomCategory().NewSet(rs.Env()).GetRecord("product_uom_categ_wtime")
+			for _, tmpl := range rs.Records() {
+				if tmpl.Warranty() < 0 {
+					log.Panic(rs.T("Error: The warranty of a product cannot be negative."))
+				}
+				if !tmpl.WarrantyUom().IsEmpty() && !tmpl.WarrantyUom().Category().Equals(wtime) {
+					log.Panic(rs.T("Error: The warranty of a product must be expressed in a time unit."))
+				}
+			}
+		})
+
+	h.ProductProduct().AddFields(map[string]models.FieldDefinition{
+		"WarrantyOverride": models.BooleanField{String: "Specific Warranty",
+			Help: "If set, this variant has its own warranty instead of the warranty of its product."},
+		"VariantWarranty": models.FloatField{String: "Variant Warranty",
+			Constraint: h.ProductProduct().Methods().CheckWarranty(),
+			Help:       "Duration of the warranty of this variant, expressed in the variant warranty unit."},
+		"VariantWarrantyUom": models.Many2OneField{String: "Variant Warranty Unit", RelationModel: h.ProductUom(),
+			Filter:     q.ProductUom().CategoryFilteredOn(q.ProductUomCategory().HexyaExternalID().Equals("product_uom_categ_wtime")),
+			Constraint: h.ProductProduct().Methods().CheckWarranty(),
+			Help:       "Time unit of the variant warranty. Warranties without unit are expressed in months."},
+	})
+
+	h.ProductProduct().Methods().CheckWarranty().DeclareMethod(
+		`CheckWarranty checks that the specific warranty of this variant is not negative and expressed in a time unit.`,
+		func(rs m.ProductProductSet) {
+			wtime := h.ProductUomCategory().NewSet(rs.Env()).GetRecord("product_uom_categ_wtime")
+			for _, product := range rs.Records() {
+				if product.VariantWarranty() < 0 {
+					log.Panic(rs.T("Error: The warranty of a product cannot be negative."))
+				}
+				if !product.VariantWarrantyUom().IsEmpty() && !product.VariantWarrantyUom().Category().Equals(wtime) {
+					log.Panic(rs.T("Error: The warranty of a product must be expressed in a time unit."))
+				}
+			}
+		})
+
+	h.ProductProduct().Methods().WarrantyDuration().DeclareMethod(
+		`WarrantyDuration returns the warranty of this variant and its time unit. It is the specific warranty
+		of the variant if it has one, or the warranty of its product otherwise.`,
+		func(rs m.ProductProductSet) (float64, m.ProductUomSet) {
+			rs.EnsureOne()
+			duration, uom := rs.ProductTmpl().Warranty(), rs.ProductTmpl().WarrantyUom()
+			if rs.WarrantyOverride() {
+				duration, uom = rs.VariantWarranty(), rs.VariantWarrantyUom()
+			}
+			if uom.IsEmpty() {
+				uom = h.ProductUom().NewSet(rs.Env()).GetRecord("product_product_uom_month")
+			}
+			return duration, uom
+		})
+
+	h.ProductProduct().Methods().WarrantyExpiry().DeclareMethod(
+		`WarrantyExpiry returns the date at which the warranty of this variant ends if it has been sold
+		or delivered at the given date. It returns a zero date if this variant has no warranty.`,
+		func(rs m.ProductProductSet, date dates.Date) dates.Date {
+			rs.EnsureOne()
+			duration, uom := rs.WarrantyDuration()
+			if duration == 0 {
+				return dates.Date{}
+			}
+			return uom.AddDuration(date, duration)
+		})
+
+	h.ProductProduct().Methods().UnderWarranty().DeclareMethod(
+		`UnderWarranty returns true if this variant, sold or delivered at the given date,
+		is still covered by its warranty at checkDate. If checkDate is zero, today is used.`,
+		func(rs m.ProductProductSet, date, checkDate dates.Date) bool {
+			rs.EnsureOne()
+			if checkDate.IsZero() {
+				checkDate = dates.Today()
+			}
+			expiry := rs.WarrantyExpiry(date)
+			if expiry.IsZero() || checkDate.Lower(date) {
+				return false
+			}
+			return !checkDate.Greater(expiry)
+		})
+
+}
+
+// addMonths returns the given date shifted by the given number of months. The day is
+// clamped to the last day of the target month if this month is shorter.
+func addMonths(date dates.Date, months int) dates.Date {
+	target := date.StartOfMonth().AddDate(0, months, 0)
+	lastDay := target.AddDate(0, 1, -1).Day()
+	if date.Day() > lastDay {
+		return target.SetDay(lastDay)
+	}
+	return target.SetDay(date.Day())
+}
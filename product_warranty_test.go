@@ -0,0 +1,67 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package product
+
+import (
+	"testing"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWarranty(t *testing.T) {
+	Convey("Testing warranties", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			uomHour := h.ProductUom().NewSet(env).GetRecord("product_product_uom_hour")
+			uomWeek := h.ProductUom().NewSet(env).GetRecord("product_product_uom_week")
+			uomMonth := h.ProductUom().NewSet(env).GetRecord("product_product_uom_month")
+			uomYear := h.ProductUom().NewSet(env).GetRecord("product_product_uom_year")
+			saleDate := dates.ParseDate("2018-01-31")
+			Convey("Durations should be added with calendar arithmetic", func() {
+				So(uomWeek.AddDuration(saleDate, 2).String(), ShouldEqual, "2018-02-14")
+				So(uomMonth.AddDuration(saleDate, 12).String(), ShouldEqual, "2019-01-31")
+				So(uomYear.AddDuration(saleDate, 2).String(), ShouldEqual, "2020-01-31")
+				So(uomHour.AddDuration(saleDate, 30).String(), ShouldEqual, "2018-02-01")
+			})
+			Convey("Months should be clamped to the end of shorter months", func() {
+				So(uomMonth.AddDuration(saleDate, 1).String(), ShouldEqual, "2018-02-28")
+				So(uomMonth.AddDuration(saleDate, 3).String(), ShouldEqual, "2018-04-30")
+				So(uomMonth.AddDuration(dates.ParseDate("2018-02-28"), 1).String(), ShouldEqual, "2018-03-28")
+				So(uomYear.AddDuration(dates.ParseDate("2016-02-29"), 1).String(), ShouldEqual, "2017-02-28")
+			})
+			Convey("Durations should not depend on the unit codes", func() {
+				uomMonth.SetUneceCode("")
+				uomWeek.SetUneceCode("MON")
+				So(uomMonth.AddDuration(saleDate, 1).String(), ShouldEqual, "2018-02-28")
+				So(uomWeek.AddDuration(saleDate, 2).String(), ShouldEqual, "2018-02-14")
+			})
+			Convey("Variants should use the warranty of their product unless overridden", func() {
+				product := ptd.product71
+				product.ProductTmpl().SetWarranty(2)
+				product.ProductTmpl().SetWarrantyUom(uomYear)
+				So(product.WarrantyExpiry(saleDate).String(), ShouldEqual, "2020-01-31")
+				So(ptd.product72.WarrantyExpiry(saleDate).String(), ShouldEqual, "2020-01-31")
+				product.SetWarrantyOverride(true)
+				product.SetVariantWarranty(6)
+				product.SetVariantWarrantyUom(uomMonth)
+				So(product.WarrantyExpiry(saleDate).String(), ShouldEqual, "2018-07-31")
+				So(ptd.product72.WarrantyExpiry(saleDate).String(), ShouldEqual, "2020-01-31")
+				So(product.UnderWarranty(saleDate, dates.ParseDate("2018-07-31")), ShouldBeTrue)
+				So(product.UnderWarranty(saleDate, dates.ParseDate("2018-08-01")), ShouldBeFalse)
+				product.SetVariantWarranty(0)
+				So(product.WarrantyExpiry(saleDate).IsZero(), ShouldBeTrue)
+				So(product.UnderWarranty(saleDate, saleDate), ShouldBeFalse)
+			})
+			Convey("Warranties should not be negative and should use time units", func() {
+				So(func() { ptd.product1.ProductTmpl().SetWarranty(-1) }, ShouldPanic)
+				So(func() { ptd.product1.ProductTmpl().SetWarrantyUom(ptd.uomDozen) }, ShouldPanic)
+				So(func() { ptd.product1.SetVariantWarrantyUom(ptd.uomWeight) }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
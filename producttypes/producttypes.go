@@ -0,0 +1,40 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package producttypes
+
+// A PackagingQuantity is a number of full packages of a given ProductPackaging
+type PackagingQuantity struct {
+	// PackagingID is the ID of the ProductPackaging record
+	PackagingID int64
+	// Packages is the number of full packages
+	Packages float64
+	// Qty is the quantity of product contained in all these packages,
+	// expressed in the unit of measure that was asked for.
+	Qty float64
+}
+
+// A RentalPeriod is a number of periods of a given ProductRentalRate
+type RentalPeriod struct {
+	// RateID is the ID of the ProductRentalRate record
+	RateID int64
+	// Periods is the number of periods charged at this rate
+	Periods int
+	// Price is the price of all these periods, in the currency of the rate's product
+	Price float64
+}
+
+// A VariantsPreview describes the changes that CreateVariants would make on the
+// variants of a product template
+type VariantsPreview struct {
+	// ToCreate holds the IDs of the attribute values of each variant to create
+	ToCreate [][]int64
+	// ToActivate holds the IDs of the archived variants to reactivate
+	ToActivate []int64
+	// ToUnlink holds the IDs of the variants to delete
+	ToUnlink []int64
+	// ToDeactivate holds the IDs of the variants to archive because they are still in use
+	ToDeactivate []int64
+	// VariantCount is the number of active variants of the template after the changes
+	VariantCount int
+}
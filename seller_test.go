@@ -8,7 +8,10 @@ import (
 
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -33,6 +36,207 @@ func TestSeller(t *testing.T) {
 				contextCode := productService.WithContext("partner_id", campToCamp.ID()).Code()
 				So(contextCode, ShouldEqual, "C2CCODE")
 			})
+			Convey("Vendors should be selected according to the policy", func() {
+				asusOffer := h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+					SetName(asusTec).
+					SetSequence(1).
+					SetPrice(100).
+					SetDelay(10))
+				c2cOffer := h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+					SetName(campToCamp).
+					SetSequence(2).
+					SetPrice(80).
+					SetDelay(20))
+				productService.SetSellers(asusOffer.Union(c2cOffer))
+				noPartner := h.Partner().NewSet(env)
+				noUom := h.ProductUom().NewSet(env)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, noUom, "").Equals(asusOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, noUom, "sequence").Equals(asusOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, noUom, "price").Equals(c2cOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, noUom, "delay").Equals(asusOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, noUom, "score").Equals(asusOffer), ShouldBeTrue)
+				So(productService.WithContext("seller_delay_weight", 0.1).
+					SelectSeller(noPartner, 1, dates.Date{}, noUom, "score").Equals(c2cOffer), ShouldBeTrue)
+				ranked := productService.RankSellers(noPartner, 1, dates.Date{}, noUom, "price").Records()
+				So(ranked, ShouldHaveLength, 2)
+				So(ranked[0].Equals(c2cOffer), ShouldBeTrue)
+				So(ranked[1].Equals(asusOffer), ShouldBeTrue)
+			})
+			Convey("Vendor units of measure should be converted", func() {
+				uomUnit := h.ProductUom().NewSet(env).GetRecord("product_product_uom_unit")
+				uomDozen := h.ProductUom().NewSet(env).GetRecord("product_product_uom_dozen")
+				uomKm := h.ProductUom().NewSet(env).GetRecord("product_product_uom_km")
+				productService.SetUom(uomUnit)
+				productService.SetUomPo(uomUnit)
+				asusOffer := h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+					SetName(asusTec).
+					SetSequence(1).
+					SetProductUom(uomDozen).
+					SetMinQty(1).
+					SetPrice(96))
+				c2cOffer := h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+					SetName(campToCamp).
+					SetSequence(2).
+					SetPrice(10))
+				productService.SetSellers(asusOffer.Union(c2cOffer))
+				So(asusOffer.PurchaseUom().Equals(uomDozen), ShouldBeTrue)
+				So(c2cOffer.PurchaseUom().Equals(uomUnit), ShouldBeTrue)
+				So(asusOffer.MinQtyIn(uomUnit), ShouldAlmostEqual, 12, 0.01)
+				So(asusOffer.PriceIn(uomUnit), ShouldAlmostEqual, 8, 0.01)
+				So(c2cOffer.PriceIn(uomDozen), ShouldAlmostEqual, 120, 0.01)
+				So(asusOffer.ComparablePrice(productService), ShouldAlmostEqual, 8, 0.01)
+				noPartner := h.Partner().NewSet(env)
+				noUom := h.ProductUom().NewSet(env)
+				So(productService.SelectSeller(noPartner, 6, dates.Date{}, noUom, "").Equals(c2cOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 12, dates.Date{}, noUom, "").Equals(asusOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, uomDozen, "").Equals(asusOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 12, dates.Date{}, uomUnit, "price").Equals(asusOffer), ShouldBeTrue)
+				So(func() { asusOffer.SetProductUom(uomKm) }, ShouldPanic)
+			})
+			Convey("Vendor catalogues should be imported", func() {
+				asusOffer := h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+					SetName(asusTec).
+					SetPrice(100).
+					SetDateStart(dates.ParseDate("2026-01-01")))
+				productService.SetSellers(asusOffer)
+				catalogue := []byte(`default_code,barcode,product_code,min_qty,price,date_start
+DEFCODE,,,0,90,2026-04-01
+DEFCODE,,,10,85,
+UNKNOWN,,,0,10,
+DEFCODE,,,0,abc,
+DEFCODE,,,0
+`)
+				start := dates.ParseDate("2026-04-01")
+				statuses := func(lines []m.ProductSupplierinfoImportLineData) []string {
+					var res []string
+					for _, line := range lines {
+						res = append(res, line.Status())
+					}
+					return res
+				}
+				lines := h.ProductSupplierinfo().NewSet(env).ImportCatalogue(asusTec, catalogue, start, true)
+				So(statuses(lines), ShouldResemble, []string{"changed", "new", "unmatched", "error", "error"})
+				So(lines[0].OldPrice(), ShouldEqual, 100)
+				So(asusOffer.Price(), ShouldEqual, 100)
+				So(productService.Sellers().Len(), ShouldEqual, 1)
+				lines = h.ProductSupplierinfo().NewSet(env).ImportCatalogue(asusTec, catalogue, start, false)
+				So(statuses(lines), ShouldResemble, []string{"changed", "new", "unmatched", "error", "error"})
+				So(asusOffer.Price(), ShouldEqual, 100)
+				So(asusOffer.DateEnd().Equal(dates.ParseDate("2026-03-31")), ShouldBeTrue)
+				So(productService.Sellers().Len(), ShouldEqual, 3)
+				So(lines[0].Supplierinfo().Price(), ShouldEqual, 90)
+				So(lines[1].Supplierinfo().MinQty(), ShouldEqual, 10)
+				lines = h.ProductSupplierinfo().NewSet(env).ImportCatalogue(asusTec, catalogue, start, false)
+				So(statuses(lines), ShouldResemble, []string{"unchanged", "unchanged", "unmatched", "error", "error"})
+				So(productService.Sellers().Len(), ShouldEqual, 3)
+			})
+			Convey("Catalogue minimal quantities should be compared in the catalogue unit", func() {
+				uomUnit := h.ProductUom().NewSet(env).GetRecord("product_product_uom_unit")
+				uomDozen := h.ProductUom().NewSet(env).GetRecord("product_product_uom_dozen")
+				productService.SetUom(uomUnit)
+				productService.SetUomPo(uomUnit)
+				asusOffer := h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+					SetName(asusTec).
+					SetProductUom(uomDozen).
+					SetMinQty(1).
+					SetPrice(100).
+					SetDateStart(dates.ParseDate("2026-01-01")))
+				productService.SetSellers(asusOffer)
+				catalogue := []byte(`default_code,min_qty,price,uom
+DEFCODE,12,8,C62
+DEFCODE,1,96,DZN
+`)
+				lines := h.ProductSupplierinfo().NewSet(env).ImportCatalogue(asusTec, catalogue, dates.ParseDate("2026-01-01"), true)
+				So(lines, ShouldHaveLength, 2)
+				So(lines[0].Status(), ShouldEqual, "changed")
+				So(lines[0].Supplierinfo().Equals(asusOffer), ShouldBeTrue)
+				So(lines[1].Status(), ShouldEqual, "changed")
+				So(lines[1].Supplierinfo().Equals(asusOffer), ShouldBeTrue)
+			})
+			Convey("Observed lead times should be used to rank vendors", func() {
+				asusOffer := h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+					SetName(asusTec).
+					SetSequence(1).
+					SetPrice(100).
+					SetDelay(5))
+				c2cOffer := h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+					SetName(campToCamp).
+					SetSequence(2).
+					SetPrice(100).
+					SetDelay(8).
+					SetAutoDelay(true))
+				productService.SetSellers(asusOffer.Union(c2cOffer))
+				orderDate := dates.ParseDate("2026-03-02")
+				for _, days := range []int{4, 6, 12, 7} {
+					productService.RecordVendorLeadTime(asusTec, orderDate, orderDate.AddDate(0, 0, days), "")
+				}
+				So(asusOffer.LeadTimeCount(), ShouldEqual, 4)
+				So(asusOffer.LeadTimeMean(), ShouldAlmostEqual, 7.25, 0.001)
+				So(asusOffer.LeadTimeP90(), ShouldEqual, 12)
+				So(asusOffer.OnTimeRate(), ShouldAlmostEqual, 0.25, 0.001)
+				So(asusOffer.Delay(), ShouldEqual, 5)
+				for _, days := range []int{7, 8, 9} {
+					c2cOffer.RecordLeadTime(orderDate, orderDate.AddDate(0, 0, days), "")
+				}
+				So(c2cOffer.OnTimeRate(), ShouldAlmostEqual, 1.0/3, 0.001)
+				So(c2cOffer.Delay(), ShouldEqual, 9)
+				So(func() { c2cOffer.RecordLeadTime(orderDate, orderDate.AddDate(0, 0, -1), "") }, ShouldPanic)
+				noPartner := h.Partner().NewSet(env)
+				noUom := h.ProductUom().NewSet(env)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, noUom, "delay").Equals(asusOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, noUom, "lead_time").Equals(asusOffer), ShouldBeTrue)
+				So(productService.SelectSeller(noPartner, 1, dates.Date{}, noUom, "reliability").Equals(c2cOffer), ShouldBeTrue)
+				So(productService.WithContext("seller_delay_weight", 0.0).WithContext("seller_reliability_weight", 1.0).
+					SelectSeller(noPartner, 1, dates.Date{}, noUom, "score").Equals(c2cOffer), ShouldBeTrue)
+				late := c2cOffer.LeadTimes().Filtered(func(r m.ProductSupplierinfoLeadTimeSet) bool {
+					return r.Duration() == 9
+				})
+				So(late.OnTime(), ShouldBeFalse)
+				late.SetReceiptDate(orderDate.AddDate(0, 0, 3))
+				So(late.Duration(), ShouldEqual, 3)
+				So(late.OnTime(), ShouldBeTrue)
+				So(func() { late.SetOrderDate(orderDate.AddDate(0, 0, 4)) }, ShouldPanic)
+			})
+			Convey("Expiring and superseded vendor prices should be detected", func() {
+				today := dates.Today()
+				newSeller := func(vendor m.PartnerSet, start, end dates.Date) m.ProductSupplierinfoSet {
+					return h.ProductSupplierinfo().Create(env, h.ProductSupplierinfo().NewData().
+						SetName(vendor).
+						SetPrice(10).
+						SetProductTmpl(productService.ProductTmpl()).
+						SetDateStart(start).
+						SetDateEnd(end))
+				}
+				asusSoon := newSeller(asusTec, dates.Date{}, today.AddDate(0, 0, 5))
+				c2cLater := newSeller(campToCamp, dates.Date{}, today.AddDate(0, 0, 20))
+				asusOld := newSeller(asusTec, today.AddDate(0, 0, -40), today.AddDate(0, 0, -10))
+				asusNew := newSeller(asusTec, today.AddDate(0, 0, -9), dates.Date{})
+				c2cOld := newSeller(campToCamp, dates.Date{}, today.AddDate(0, 0, -3))
+				expiring := h.ProductSupplierinfo().NewSet(env).ExpiringByVendor(10)
+				So(expiring, ShouldHaveLength, 1)
+				So(expiring[asusTec.ID()].Equals(asusSoon), ShouldBeTrue)
+				expiring = h.ProductSupplierinfo().NewSet(env).ExpiringByVendor(30)
+				So(expiring, ShouldHaveLength, 2)
+				So(expiring[campToCamp.ID()].Equals(c2cLater), ShouldBeTrue)
+				archived := h.ProductSupplierinfo().NewSet(env).CleanSuperseded(false)
+				So(archived.Equals(asusOld), ShouldBeTrue)
+				So(asusOld.Active(), ShouldBeFalse)
+				So(asusNew.Active(), ShouldBeTrue)
+				So(c2cOld.Active(), ShouldBeTrue)
+				oldDate := today.AddDate(0, 0, -20)
+				ranked := productService.RankSellers(asusTec, 1, oldDate, h.ProductUom().NewSet(env), "")
+				So(ranked.Intersect(asusOld).IsEmpty(), ShouldBeTrue)
+				So(ranked.Intersect(asusSoon).IsEmpty(), ShouldBeFalse)
+				observation := productService.RecordVendorLeadTime(asusTec, oldDate, oldDate.AddDate(0, 0, 3), "PO001")
+				So(observation.Supplierinfo().Equals(asusOld), ShouldBeFalse)
+				So(asusOld.LeadTimes().IsEmpty(), ShouldBeTrue)
+				c2cNew := newSeller(campToCamp, today.AddDate(0, 0, -2), dates.Date{})
+				So(h.ProductSupplierinfo().NewSet(env).CleanSuperseded(true).IsEmpty(), ShouldBeTrue)
+				So(h.ProductSupplierinfo().NewSet(env).WithContext("active_test", false).Search(
+					q.ProductSupplierinfo().ID().Equals(c2cOld.ID())).IsEmpty(), ShouldBeTrue)
+				So(c2cNew.Active(), ShouldBeTrue)
+				So(asusOld.Active(), ShouldBeFalse)
+			})
 		}), ShouldBeNil)
 	})
 }
@@ -46,6 +46,64 @@ func TestUom(t *testing.T) {
 				// Unlike Odoo, we do not want to go into rounding issues with epsilons.
 				So(qty, ShouldEqual, 0)
 			})
+			Convey("Lookup by standard codes", func() {
+				So(uomKgm.GetByUneceCode("KGM", h.ProductUomCategory().NewSet(env)).Equals(uomKgm), ShouldBeTrue)
+				So(uomKgm.GetByUneceCode("kgm", uomKgm.Category()).Equals(uomKgm), ShouldBeTrue)
+				So(uomKgm.GetByUneceCode("KGM", categUnit).IsEmpty(), ShouldBeTrue)
+				So(uomKgm.GetByUcumCode("g", h.ProductUomCategory().NewSet(env)).Equals(uomGram), ShouldBeTrue)
+				So(uomKgm.GetByUcumCode("G", h.ProductUomCategory().NewSet(env)).IsEmpty(), ShouldBeTrue)
+				So(uomDozen.GetByCategory(categUnit).Intersect(uomUnit.Union(uomDozen)).Len(), ShouldEqual, 2)
+				So(categUnit.ReferenceUom().Equals(uomUnit), ShouldBeTrue)
+				uomLb := uomKgm.GetByUneceCode("LBR", h.ProductUomCategory().NewSet(env))
+				So(uomLb.ComputeQuantity(1, uomKgm, true), ShouldEqual, 0.454)
+			})
+			Convey("Conversion matrix and consistency checks", func() {
+				matrix := categUnit.ConversionMatrix()
+				So(matrix[uomDozen.ID()][uomUnit.ID()], ShouldAlmostEqual, 12.0, 0.0001)
+				So(matrix[uomUnit.ID()][uomUnit.ID()], ShouldEqual, 1.0)
+				So(categUnit.CheckConsistency(), ShouldBeEmpty)
+
+				h.ProductUom().Create(env, h.ProductUom().NewData().
+					SetName("Pallet").
+					SetFactorInv(100).
+					SetUomType("bigger").
+					SetRounding(10).
+					SetCategory(categUnit))
+				uomUnit.SetActive(false)
+				var issues []string
+				for _, line := range categUnit.CheckConsistency() {
+					issues = append(issues, line.Issue())
+				}
+				So(issues, ShouldContain, "rounding")
+				So(issues, ShouldContain, "inactive_reference")
+				So(issues, ShouldNotContain, "factor")
+				So(issues, ShouldNotContain, "factor_inv")
+			})
+			Convey("Ratios inconsistent with the unit type should be reported", func() {
+				half := h.ProductUom().Create(env, h.ProductUom().NewData().
+					SetName("Half").
+					SetFactor(0.5).
+					SetUomType("smaller").
+					SetCategory(categUnit))
+				lines := categUnit.CheckConsistency()
+				So(lines, ShouldHaveLength, 1)
+				So(lines[0].Issue(), ShouldEqual, "factor")
+				So(lines[0].Uom().Equals(half), ShouldBeTrue)
+			})
+			Convey("Products with units in different categories should be reported once", func() {
+				h.ProductTemplate().NewSet(env).WithContext("hexya_skip_check_constraints", true).Create(
+					h.ProductTemplate().NewData().
+						SetName("Mismatch").
+						SetUom(uomUnit).
+						SetUomPo(uomKgm))
+				var mismatches int
+				for _, line := range categUnit.Union(uomKgm.Category()).CheckConsistency() {
+					if line.Issue() == "category_mismatch" {
+						mismatches++
+					}
+				}
+				So(mismatches, ShouldEqual, 1)
+			})
 		}), ShouldBeNil)
 	})
 }
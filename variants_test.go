@@ -4,11 +4,14 @@
 package product
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/operator"
 	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
 	"github.com/hexya-erp/pool/q"
@@ -187,6 +190,43 @@ func TestVariants(t *testing.T) {
 					}
 				}
 			})
+			Convey("Exclusion rules", func() {
+				testTemplate := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+					SetName("Sofa").
+					SetUom(ptd.uomUnit).
+					SetUomPo(ptd.uomUnit).
+					CreateAttributeLines(
+						h.ProductAttributeLine().NewData().
+							SetAttribute(sizeAttr).
+							SetValues(sizeAttreValueS.Union(sizeAttreValueM).Union(sizeAttreValueL))).
+					CreateAttributeLines(
+						h.ProductAttributeLine().NewData().
+							SetAttribute(ptd.prodAtt1).
+							SetValues(ptd.prodAttr1V1.Union(ptd.prodAttr1V2))))
+				So(testTemplate.ProductVariants().Len(), ShouldEqual, 6)
+				withLV2 := func(rs m.ProductProductSet) bool {
+					return rs.AttributeValues().Equals(sizeAttreValueL.Union(ptd.prodAttr1V2))
+				}
+				So(testTemplate.ProductVariants().Filtered(withLV2).Len(), ShouldEqual, 1)
+				rule := h.ProductAttributeExclusion().Create(env, h.ProductAttributeExclusion().NewData().
+					SetProductTmpl(testTemplate).
+					SetValue(sizeAttreValueL).
+					SetExcludedValues(ptd.prodAttr1V2))
+				So(testTemplate.ProductVariants().Len(), ShouldEqual, 5)
+				So(testTemplate.IsCombinationExcluded(sizeAttreValueL.Union(ptd.prodAttr1V2)), ShouldBeTrue)
+				So(testTemplate.IsCombinationExcluded(sizeAttreValueL.Union(ptd.prodAttr1V1)), ShouldBeFalse)
+				So(testTemplate.ProductVariants().Filtered(withLV2).IsEmpty(), ShouldBeTrue)
+				rule.SetExcludedValues(ptd.prodAttr1V1.Union(ptd.prodAttr1V2))
+				So(testTemplate.ProductVariants().Len(), ShouldEqual, 4)
+				rule.Unlink()
+				So(testTemplate.ProductVariants().Len(), ShouldEqual, 6)
+				So(func() {
+					h.ProductAttributeExclusion().Create(env, h.ProductAttributeExclusion().NewData().
+						SetProductTmpl(testTemplate).
+						SetValue(sizeAttreValueL).
+						SetExcludedValues(sizeAttreValueS))
+				}, ShouldPanic)
+			})
 		}), ShouldBeNil)
 	})
 }
@@ -341,3 +381,544 @@ func TestVariantsNoCreate(t *testing.T) {
 		}), ShouldBeNil)
 	})
 }
+
+func TestVariantsDynamic(t *testing.T) {
+	Convey("Testing dynamic variants", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			size := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+				SetName("Size").
+				SetCreateVariantMode("dynamic"))
+			sizeS := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetName("S").
+				SetAttribute(size))
+			sizeM := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetName("M").
+				SetAttribute(size))
+			ptd := getProductTestData(env)
+			template := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+				SetName("Sofa").
+				SetUom(ptd.uomUnit).
+				SetUomPo(ptd.uomUnit).
+				CreateAttributeLines(
+					h.ProductAttributeLine().NewData().
+						SetAttribute(size).
+						SetValues(sizeS.Union(sizeM))).
+				CreateAttributeLines(
+					h.ProductAttributeLine().NewData().
+						SetAttribute(ptd.prodAtt1).
+						SetValues(ptd.prodAttr1V1.Union(ptd.prodAttr1V2))))
+			Convey("Creation modes should be kept consistent with the CreateVariant flag", func() {
+				So(size.CreateVariant(), ShouldBeTrue)
+				size.SetCreateVariantMode("never")
+				So(size.CreateVariant(), ShouldBeFalse)
+				size.SetCreateVariant(true)
+				So(size.CreateVariantMode(), ShouldEqual, "always")
+			})
+			Convey("Dynamic variants should only be created on demand", func() {
+				So(template.HasDynamicAttributes(), ShouldBeTrue)
+				So(template.ProductVariants().IsEmpty(), ShouldBeTrue)
+				variant := template.GetOrCreateVariant(sizeM.Union(ptd.prodAttr1V1))
+				So(variant.AttributeValues().Equals(sizeM.Union(ptd.prodAttr1V1)), ShouldBeTrue)
+				So(template.ProductVariants().Len(), ShouldEqual, 1)
+				So(template.GetOrCreateVariant(sizeM.Union(ptd.prodAttr1V1)).Equals(variant), ShouldBeTrue)
+				So(template.ProductVariants().Len(), ShouldEqual, 1)
+				template.GetOrCreateVariant(sizeS.Union(ptd.prodAttr1V1))
+				So(template.ProductVariants().Len(), ShouldEqual, 2)
+			})
+			Convey("Reactivated variants should respect the variant limit", func() {
+				template.SetMaxVariants(1)
+				variant := template.GetOrCreateVariant(sizeM.Union(ptd.prodAttr1V1))
+				variant.SetActive(false)
+				template.GetOrCreateVariant(sizeS.Union(ptd.prodAttr1V1))
+				So(func() { template.GetOrCreateVariant(sizeM.Union(ptd.prodAttr1V1)) }, ShouldPanic)
+				So(variant.Active(), ShouldBeFalse)
+			})
+			Convey("Impossible combinations should not be created", func() {
+				So(func() { template.GetOrCreateVariant(sizeM) }, ShouldPanic)
+				So(func() { template.GetOrCreateVariant(sizeS.Union(sizeM).Union(ptd.prodAttr1V1)) }, ShouldPanic)
+				h.ProductAttributeExclusion().Create(env, h.ProductAttributeExclusion().NewData().
+					SetProductTmpl(template).
+					SetValue(sizeS).
+					SetExcludedValues(ptd.prodAttr1V2))
+				So(func() { template.GetOrCreateVariant(sizeS.Union(ptd.prodAttr1V2)) }, ShouldPanic)
+			})
+			Convey("Variants that become impossible should be removed", func() {
+				template.GetOrCreateVariant(sizeS.Union(ptd.prodAttr1V2))
+				template.GetOrCreateVariant(sizeM.Union(ptd.prodAttr1V2))
+				So(template.ProductVariants().Len(), ShouldEqual, 2)
+				h.ProductAttributeExclusion().Create(env, h.ProductAttributeExclusion().NewData().
+					SetProductTmpl(template).
+					SetValue(sizeS).
+					SetExcludedValues(ptd.prodAttr1V2))
+				So(template.ProductVariants().Len(), ShouldEqual, 1)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestVariantsLimit(t *testing.T) {
+	Convey("Testing variant limits", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			size := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().SetName("Size"))
+			sizeS := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetName("S").
+				SetAttribute(size))
+			sizeM := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetName("M").
+				SetAttribute(size))
+			sizeL := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetName("L").
+				SetAttribute(size))
+			ptd := getProductTestData(env)
+			template := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+				SetName("Sofa").
+				SetUom(ptd.uomUnit).
+				SetUomPo(ptd.uomUnit).
+				SetMaxVariants(4).
+				CreateAttributeLines(
+					h.ProductAttributeLine().NewData().
+						SetAttribute(size).
+						SetValues(sizeS.Union(sizeM))))
+			sizeLine := template.AttributeLines()
+			So(template.ProductVariants().Len(), ShouldEqual, 2)
+			Convey("Previewing variants should not change anything", func() {
+				sizeLine.SetValues(sizeM.Union(sizeL))
+				preview := template.PreviewVariants()
+				So(preview.ToCreate, ShouldHaveLength, 1)
+				So(preview.ToCreate[0], ShouldResemble, sizeL.Ids())
+				So(preview.ToUnlink, ShouldHaveLength, 1)
+				So(preview.ToActivate, ShouldBeEmpty)
+				So(preview.ToDeactivate, ShouldBeEmpty)
+				So(preview.VariantCount, ShouldEqual, 2)
+				So(template.ProductVariants().Len(), ShouldEqual, 2)
+			})
+			Convey("Archived variants should be previewed for reactivation", func() {
+				sizeSVariant := template.ProductVariants().Filtered(func(r m.ProductProductSet) bool {
+					return r.AttributeValues().Equals(sizeS)
+				})
+				sizeSVariant.SetActive(false)
+				preview := template.PreviewVariants()
+				So(preview.ToActivate, ShouldResemble, sizeSVariant.Ids())
+				So(preview.ToUnlink, ShouldBeEmpty)
+				So(preview.ToCreate, ShouldBeEmpty)
+				So(preview.VariantCount, ShouldEqual, 2)
+			})
+			Convey("Archived variants should not get a second value of single value attributes", func() {
+				fabric := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().SetName("Fabric"))
+				cotton := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+					SetName("Cotton").
+					SetAttribute(fabric))
+				linen := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+					SetName("Linen").
+					SetAttribute(fabric))
+				template.Write(h.ProductTemplate().NewData().
+					CreateAttributeLines(h.ProductAttributeLine().NewData().
+						SetAttribute(fabric).
+						SetValues(cotton)))
+				sizeSVariant := template.ProductVariants().Filtered(func(r m.ProductProductSet) bool {
+					return r.AttributeValues().Equals(sizeS.Union(cotton))
+				})
+				So(sizeSVariant.Len(), ShouldEqual, 1)
+				sizeSVariant.SetActive(false)
+				// keep the variant from being deleted once it becomes impossible
+				h.ProductKitLine().Create(env, h.ProductKitLine().NewData().
+					SetKitTmpl(ptd.product1.ProductTmpl()).
+					SetProduct(sizeSVariant))
+				template.AttributeLines().Filtered(func(r m.ProductAttributeLineSet) bool {
+					return r.Attribute().Equals(fabric)
+				}).SetValues(linen)
+				template.CreateVariants()
+				So(sizeSVariant.AttributeValues().Equals(sizeS.Union(cotton)), ShouldBeTrue)
+			})
+			Convey("Variants used elsewhere should be archived instead of deleted", func() {
+				sizeSVariant := template.ProductVariants().Filtered(func(r m.ProductProductSet) bool {
+					return r.AttributeValues().Equals(sizeS)
+				})
+				h.ProductKitLine().Create(env, h.ProductKitLine().NewData().
+					SetKitTmpl(ptd.product1.ProductTmpl()).
+					SetProduct(sizeSVariant))
+				sizeLine.SetValues(sizeM)
+				preview := template.PreviewVariants()
+				So(preview.ToDeactivate, ShouldResemble, sizeSVariant.Ids())
+				So(preview.ToUnlink, ShouldBeEmpty)
+			})
+			Convey("Templates should not get more variants than their limit", func() {
+				addColors := h.ProductTemplate().NewData().
+					CreateAttributeLines(h.ProductAttributeLine().NewData().
+						SetAttribute(ptd.prodAtt1).
+						SetValues(ptd.prodAttr1V1.Union(ptd.prodAttr1V2)))
+				sizeLine.SetValues(sizeS.Union(sizeM).Union(sizeL))
+				So(template.PreviewVariants().VariantCount, ShouldEqual, 3)
+				So(func() { template.Write(addColors) }, ShouldPanic)
+				So(template.ProductVariants().Len(), ShouldEqual, 2)
+				template.SetMaxVariants(6)
+				template.CreateVariants()
+				So(template.ProductVariants().Len(), ShouldEqual, 6)
+			})
+			Convey("Templates without limit should use the limit of their company", func() {
+				company := h.User().NewSet(env).CurrentUser().Company()
+				company.SetMaxVariants(5)
+				template.SetCompany(company)
+				template.SetMaxVariants(0)
+				So(template.VariantLimit(), ShouldEqual, 5)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+// benchmarkCreateVariants returns a benchmark of CreateVariants on a template with the given
+// numbers of colours and sizes whose variants all exist already, so that only the matching
+// of the existing variants with the possible combinations is measured.
+func benchmarkCreateVariants(colours, sizes int) func(b *testing.B) {
+	return func(b *testing.B) {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			colour := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().SetName("Colour"))
+			size := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().SetName("Size"))
+			for i := 0; i < colours; i++ {
+				h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+					SetName(fmt.Sprintf("Colour %d", i)).
+					SetAttribute(colour))
+			}
+			for i := 0; i < sizes; i++ {
+				h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+					SetName(fmt.Sprintf("Size %d", i)).
+					SetAttribute(size))
+			}
+			template := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+				SetName("Shirt").
+				SetUom(ptd.uomUnit).
+				SetUomPo(ptd.uomUnit).
+				CreateAttributeLines(h.ProductAttributeLine().NewData().
+					SetAttribute(colour).
+					SetValues(colour.Values())).
+				CreateAttributeLines(h.ProductAttributeLine().NewData().
+					SetAttribute(size).
+					SetValues(size.Values())))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				template.CreateVariants()
+			}
+			b.StopTimer()
+			if count := template.ProductVariants().Len(); count != colours*sizes {
+				b.Fatalf("expected %d variants, got %d", colours*sizes, count)
+			}
+		})
+	}
+}
+
+// BenchmarkCreateVariants measures CreateVariants on templates with 100 and 500 variants.
+func BenchmarkCreateVariants(b *testing.B) {
+	for _, dims := range [][2]int{{10, 10}, {25, 20}} {
+		b.Run(fmt.Sprintf("%d", dims[0]*dims[1]), benchmarkCreateVariants(dims[0], dims[1]))
+	}
+}
+
+func TestCreateVariantsScaling(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping variants scaling test in short mode")
+	}
+	Convey("Testing the scaling of variants matching", t, func() {
+		small := testing.Benchmark(benchmarkCreateVariants(10, 10))
+		large := testing.Benchmark(benchmarkCreateVariants(25, 20))
+		Convey("Matching 500 variants should take about 5 times as long as matching 100", func() {
+			// a quadratic matching would take about 25 times as long
+			ratio := float64(large.NsPerOp()) / float64(small.NsPerOp())
+			So(ratio, ShouldBeLessThan, 12)
+		})
+	})
+}
+
+func TestAttributeCustomValues(t *testing.T) {
+	Convey("Testing attribute display types and custom values", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			engraving := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+				SetName("Engraving").
+				SetCreateVariantMode("never"))
+			customText := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetName("Custom Text").
+				SetAttribute(engraving).
+				SetIsCustom(true))
+			template := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+				SetName("Watch").
+				SetUom(ptd.uomUnit).
+				SetUomPo(ptd.uomUnit).
+				CreateAttributeLines(
+					h.ProductAttributeLine().NewData().
+						SetAttribute(ptd.prodAtt1).
+						SetValues(ptd.prodAttr1V1.Union(ptd.prodAttr1V2))).
+				CreateAttributeLines(
+					h.ProductAttributeLine().NewData().
+						SetAttribute(engraving).
+						SetValues(customText)))
+			Convey("Attributes should be displayed as radio buttons by default", func() {
+				So(engraving.DisplayType(), ShouldEqual, "radio")
+			})
+			Convey("HTML colors should be checked", func() {
+				ptd.prodAtt1.SetDisplayType("color")
+				ptd.prodAttr1V1.SetHtmlColor("#ff0000")
+				ptd.prodAttr1V2.SetHtmlColor("#00F")
+				So(ptd.prodAttr1V1.HtmlColor(), ShouldEqual, "#ff0000")
+				So(func() { ptd.prodAttr1V1.SetHtmlColor("red") }, ShouldPanic)
+				So(func() { ptd.prodAttr1V1.SetHtmlColor("#ff00") }, ShouldPanic)
+			})
+			Convey("Custom values should not create variants", func() {
+				So(template.ProductVariants().Len(), ShouldEqual, 2)
+				So(template.CustomAttributeValues().Equals(customText), ShouldBeTrue)
+			})
+			Convey("Custom values should only be allowed on attributes without variants", func() {
+				So(func() { ptd.prodAttr1V1.SetIsCustom(true) }, ShouldPanic)
+				So(func() { engraving.SetCreateVariantMode("always") }, ShouldPanic)
+			})
+			Convey("Custom texts should be validated", func() {
+				custom := h.ProductAttributeCustomValue().Create(env, h.ProductAttributeCustomValue().NewData().
+					SetValue(customText).
+					SetCustomValue("  To my love  "))
+				So(custom.CustomValue(), ShouldEqual, "To my love")
+				So(custom.NameGet(), ShouldEqual, "Engraving: To my love")
+				So(func() { custom.SetCustomValue("   ") }, ShouldPanic)
+				So(func() { custom.SetCustomValue(strings.Repeat("x", 256)) }, ShouldPanic)
+				So(func() {
+					h.ProductAttributeCustomValue().Create(env, h.ProductAttributeCustomValue().NewData().
+						SetValue(ptd.prodAttr1V1).
+						SetCustomValue("Red"))
+				}, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestTypedAttributes(t *testing.T) {
+	Convey("Testing typed attributes", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			weight := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+				SetName("Weight").
+				SetValueType("numeric").
+				SetUom(ptd.uomWeight))
+			heavy := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetAttribute(weight).
+				SetNumericValue(2))
+			light := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetAttribute(weight).
+				SetNumericValue(0.5))
+			template := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+				SetName("Dumbbell").
+				SetUom(ptd.uomUnit).
+				SetUomPo(ptd.uomUnit).
+				CreateAttributeLines(
+					h.ProductAttributeLine().NewData().
+						SetAttribute(weight).
+						SetValues(heavy.Union(light))))
+			heavyVariant := template.ProductVariants().Filtered(func(r m.ProductProductSet) bool {
+				return r.AttributeValues().Equals(heavy)
+			})
+			gram := h.ProductUom().NewSet(env).GetRecord("product_product_uom_gram")
+			Convey("Typed values should be named with their unit", func() {
+				So(heavy.Name(), ShouldEqual, "2 kg")
+				So(light.Name(), ShouldEqual, "0.5 kg")
+				So(heavyVariant.NameGet(), ShouldEqual, "Dumbbell (2 kg)")
+				heavy.SetNumericValue(2.5)
+				So(heavy.Name(), ShouldEqual, "2.5 kg")
+			})
+			Convey("Changing the unit of measure should convert the values", func() {
+				weight.SetUom(gram)
+				So(light.NumericValue(), ShouldAlmostEqual, 500, 0.001)
+				So(light.Name(), ShouldEqual, "500 g")
+				So(heavy.Name(), ShouldEqual, "2000 g")
+				So(func() { weight.SetUom(ptd.uomUnit) }, ShouldPanic)
+			})
+			Convey("Typed values should be sorted by value", func() {
+				So(weight.Values().Records()[0].Equals(light), ShouldBeTrue)
+			})
+			Convey("Variants should be searchable by range", func() {
+				variants := h.ProductProduct().Search(env,
+					weight.VariantCondition(operator.GreaterOrEqual, 1000, gram))
+				So(variants.Equals(heavyVariant), ShouldBeTrue)
+				variants = h.ProductProduct().Search(env,
+					weight.VariantCondition(operator.Lower, 10.0, h.ProductUom().NewSet(env)))
+				So(variants.Equals(template.ProductVariants()), ShouldBeTrue)
+				So(func() { weight.VariantCondition(operator.Equals, true, h.ProductUom().NewSet(env)) }, ShouldPanic)
+			})
+			Convey("Yes/No and date attributes should be formatted", func() {
+				wifi := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+					SetName("Wi-Fi").
+					SetValueType("boolean"))
+				withWifi := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+					SetAttribute(wifi).
+					SetBooleanValue(true))
+				So(withWifi.Name(), ShouldEqual, "With Wi-Fi")
+				release := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+					SetName("Release").
+					SetValueType("date"))
+				release2018 := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+					SetAttribute(release).
+					SetDateValue(dates.ParseDate("2018-03-01")))
+				So(release2018.Name(), ShouldEqual, "2018-03-01")
+			})
+			Convey("Value types should not be changed once the attribute has values", func() {
+				So(func() { weight.SetValueType("text") }, ShouldPanic)
+				memory := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+					SetName("Memory"))
+				memory16 := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+					SetName("16 GB").
+					SetAttribute(memory))
+				So(func() { memory.SetValueType("numeric") }, ShouldPanic)
+				So(memory16.Name(), ShouldEqual, "16 GB")
+			})
+			Convey("Units of measure should only be set on numeric attributes", func() {
+				size := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+					SetName("Length"))
+				So(func() { size.SetUom(gram) }, ShouldPanic)
+				size.Write(h.ProductAttribute().NewData().SetValueType("numeric").SetUom(gram))
+				So(size.Uom().Equals(gram), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttributeValueMerge(t *testing.T) {
+	Convey("Testing unique attribute values", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			Convey("Values with the same name should be rejected", func() {
+				So(func() {
+					h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+						SetName(" RED ").
+						SetAttribute(ptd.prodAtt1))
+				}, ShouldPanic)
+				So(func() { ptd.prodAttr1V2.SetName("red") }, ShouldPanic)
+				size := h.ProductAttribute().Create(env, h.ProductAttribute().NewData().
+					SetName("Size"))
+				So(func() {
+					h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+						SetName("Red").
+						SetAttribute(size))
+				}, ShouldNotPanic)
+			})
+			Convey("Duplicate values should be merged", func() {
+				noCheck := h.ProductAttributeValue().NewSet(env).WithContext("hexya_skip_check_constraints", true)
+				duplicate := noCheck.Create(h.ProductAttributeValue().NewData().
+					SetName("red").
+					SetAttribute(ptd.prodAtt1))
+				duplicate2 := noCheck.Create(h.ProductAttributeValue().NewData().
+					SetName(" RED").
+					SetAttribute(ptd.prodAtt1))
+				template := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+					SetName("Chair").
+					SetUom(ptd.uomUnit).
+					SetUomPo(ptd.uomUnit).
+					CreateAttributeLines(
+						h.ProductAttributeLine().NewData().
+							SetAttribute(ptd.prodAtt1).
+							SetValues(ptd.prodAttr1V1.Union(duplicate).Union(duplicate2))))
+				So(template.ProductVariants().Len(), ShouldEqual, 3)
+				for _, value := range duplicate.Union(duplicate2).Records() {
+					h.ProductAttributePrice().Create(env, h.ProductAttributePrice().NewData().
+						SetProductTmpl(template).
+						SetValue(value).
+						SetPriceExtra(10))
+				}
+				kept := ptd.prodAtt1.MergeDuplicateValues()
+				So(kept.Equals(ptd.prodAttr1V1), ShouldBeTrue)
+				So(h.ProductAttributeValue().Search(env,
+					q.ProductAttributeValue().ID().In(duplicate.Union(duplicate2).Ids())).IsEmpty(), ShouldBeTrue)
+				So(template.AttributeLines().Values().Equals(ptd.prodAttr1V1), ShouldBeTrue)
+				variants := template.ProductVariants()
+				So(variants.Len(), ShouldEqual, 3)
+				So(variants.AttributeValues().Equals(ptd.prodAttr1V1), ShouldBeTrue)
+				active := h.ProductProduct().Search(env,
+					q.ProductProduct().ProductTmpl().Equals(template).And().Active().Equals(true))
+				So(active.Len(), ShouldEqual, 1)
+				prices := h.ProductAttributePrice().Search(env,
+					q.ProductAttributePrice().ProductTmpl().Equals(template))
+				So(prices.Len(), ShouldEqual, 1)
+				So(prices.Value().Equals(ptd.prodAttr1V1), ShouldBeTrue)
+				So(prices.PriceExtra(), ShouldEqual, 10)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttributeValueArchive(t *testing.T) {
+	Convey("Testing attribute value archiving", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ptd := getProductTestData(env)
+			green := h.ProductAttributeValue().Create(env, h.ProductAttributeValue().NewData().
+				SetName("Green").
+				SetAttribute(ptd.prodAtt1))
+			template := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+				SetName("Lamp").
+				SetUom(ptd.uomUnit).
+				SetUomPo(ptd.uomUnit).
+				CreateAttributeLines(
+					h.ProductAttributeLine().NewData().
+						SetAttribute(ptd.prodAtt1).
+						SetValues(ptd.prodAttr1V1.Union(green))))
+			So(template.ProductVariants().Len(), ShouldEqual, 2)
+			greenVariant := template.ProductVariants().Filtered(func(r m.ProductProductSet) bool {
+				return r.AttributeValues().Equals(green)
+			})
+			redVariant := template.ProductVariants().Subtract(greenVariant)
+			activeVariants := func() m.ProductProductSet {
+				return h.ProductProduct().Search(env,
+					q.ProductProduct().ProductTmpl().Equals(template).And().Active().Equals(true))
+			}
+			Convey("Archived values should keep their variants", func() {
+				green.ArchiveValues(false)
+				So(green.Active(), ShouldBeFalse)
+				template.CreateVariants()
+				So(template.ProductVariants().Len(), ShouldEqual, 2)
+				So(greenVariant.Active(), ShouldBeTrue)
+			})
+			Convey("Archived values should not be used for new variants", func() {
+				green.ArchiveValues(false)
+				template.AttributeLines().SetValues(ptd.prodAttr1V1.Union(ptd.prodAttr1V2).Union(green))
+				template.CreateVariants()
+				So(template.ProductVariants().Len(), ShouldEqual, 3)
+				blueVariants := template.ProductVariants().Filtered(func(r m.ProductProductSet) bool {
+					return r.AttributeValues().Equals(ptd.prodAttr1V2)
+				})
+				So(blueVariants.Len(), ShouldEqual, 1)
+				So(blueVariants.Active(), ShouldBeTrue)
+				greenVariants := template.ProductVariants().Filtered(func(r m.ProductProductSet) bool {
+					return r.AttributeValues().Equals(green)
+				})
+				So(greenVariants.Equals(greenVariant), ShouldBeTrue)
+				So(template.IsCombinationPossible(green), ShouldBeFalse)
+				So(func() { template.GetOrCreateVariant(green) }, ShouldPanic)
+			})
+			Convey("Archived values should not be added to attribute lines", func() {
+				green.ArchiveValues(false)
+				So(func() {
+					h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+						SetName("Table").
+						SetUom(ptd.uomUnit).
+						SetUomPo(ptd.uomUnit).
+						CreateAttributeLines(
+							h.ProductAttributeLine().NewData().
+								SetAttribute(ptd.prodAtt1).
+								SetValues(green)))
+				}, ShouldPanic)
+			})
+			Convey("Variants can be archived with their values", func() {
+				green.ArchiveValues(true)
+				So(greenVariant.Active(), ShouldBeFalse)
+				So(activeVariants().Equals(redVariant), ShouldBeTrue)
+				So(green.ArchivedVariants().Equals(greenVariant), ShouldBeTrue)
+				Convey("Unarchiving the value should only reactivate them", func() {
+					redVariant.SetActive(false)
+					green.SetActive(true)
+					So(greenVariant.Active(), ShouldBeTrue)
+					So(redVariant.Active(), ShouldBeFalse)
+					So(activeVariants().Equals(greenVariant), ShouldBeTrue)
+					So(green.ArchivedVariants().IsEmpty(), ShouldBeTrue)
+				})
+			})
+			Convey("Values used by variants should still not be deleted", func() {
+				So(func() { green.Unlink() }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}